@@ -1,33 +1,183 @@
 package BorgCLI
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"regexp"
 	"strconv"
+	"strings"
+	"sync"
 
 	gv "github.com/hashicorp/go-version"
 )
 
 var regexBorgVersion *regexp.Regexp
+var regexCheckPartial *regexp.Regexp
+var regexPruneKeep *regexp.Regexp
+var regexPruneDelete *regexp.Regexp
+
+// newCommand runs borg with "--log-json", its stderr should be read through a LogCollector.
+func newCommand(settings BorgSettings, operation string, args []string) (*exec.Cmd, error) {
+	cmd := exec.Command("borg", append([]string{"--log-json"}, args...)...)
+	if cmd.Err != nil {
+		return nil, fmt.Errorf("%v process failed: %v", operation, cmd.Err)
+	}
+	cmd.Env = os.Environ()
+
+	// Will be escaped by cmd.Exec
+	cmd.Env = append(cmd.Env, "BORG_PASSPHRASE="+settings.Passphrase)
+
+	return cmd, nil
+}
+
+// Prefixes of the errors and warnings forwarded by a LogCollector
+const (
+	LogErrorPrefix   = "ERROR: "
+	LogWarningPrefix = "WARNING: "
+)
+
+// LogCollector reads the "--log-json" stderr of a borg process, keeping its errors and warnings apart.
+// Every message is forwarded as a plain text line, prefixed with LogErrorPrefix or LogWarningPrefix when needed,
+// and so are the lines that aren't JSON (i.e. printed by ssh).
+type LogCollector struct {
+	mutex    sync.Mutex
+	forward  io.Writer
+	partial  []byte
+	errors   []LogMessage
+	warnings []string
+	// The last line that isn't JSON
+	other string
+}
+
+func NewLogCollector(forward io.Writer) *LogCollector {
+	return &LogCollector{
+		forward: forward,
+	}
+}
+
+func (c *LogCollector) Write(p []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.partial = append(c.partial, p...)
+	for {
+		i := bytes.IndexByte(c.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := string(c.partial[:i])
+		c.partial = c.partial[i+1:]
+		if err := c.readLine(line); err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+// Close reads the last line, if it has no line break.
+func (c *LogCollector) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	line := string(c.partial)
+	c.partial = nil
+	return c.readLine(line)
+}
+
+func (c *LogCollector) readLine(line string) error {
+	if strings.TrimSpace(line) == "" {
+		return nil
+	}
+
+	var message LogMessage
+	if err := json.Unmarshal([]byte(line), &message); err != nil || message.Type == "" {
+		c.other = strings.TrimSpace(line)
+		return c.writeLine(line)
+	}
+	if message.Type != "log_message" && message.Type != "question_prompt" {
+		// Progress updates
+		return nil
+	}
+
+	switch message.LevelName {
+	case "ERROR", "CRITICAL":
+		c.errors = append(c.errors, message)
+		return c.writeLine(LogErrorPrefix + message.Message)
+	case "WARNING":
+		c.warnings = append(c.warnings, message.Message)
+		return c.writeLine(LogWarningPrefix + message.Message)
+	default:
+		return c.writeLine(message.Message)
+	}
+}
+
+func (c *LogCollector) writeLine(line string) error {
+	if c.forward == nil {
+		return nil
+	}
+	_, err := io.WriteString(c.forward, strings.TrimRight(line, "\r\n")+"\n")
+	return err
+}
+
+// Warnings returns the warnings logged by borg.
+func (c *LogCollector) Warnings() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]string{}, c.warnings...)
+}
+
+// Err turns the error of the borg process into an *Error, with the error that borg logged.
+// It returns nil when err is nil.
+func (c *LogCollector) Err(err error) error {
+	if err == nil {
+		return nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	borgErr := &Error{
+		Warnings: append([]string{}, c.warnings...),
+		Err:      err,
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		borgErr.ExitCode = exitErr.ExitCode()
+	}
+
+	// The error with a msgid is the one that ended borg, the others explain it
+	for _, message := range c.errors {
+		if message.MsgID != "" || borgErr.Message == "" {
+			borgErr.MsgID = message.MsgID
+			borgErr.Message = strings.TrimSpace(message.Message)
+		}
+	}
+	if borgErr.Message == "" && borgErr.ExitCode != 1 {
+		borgErr.Message = c.other
+	}
+	return borgErr
+}
 
 type CreateArchiveSettings struct {
-	Compression    string
-	Comment        string
+	Compression string
+	Comment     string
+	// Prints the stats of the archive to stdout, see ParseCreateStats
+	JSON           bool
 	AdditionalArgs []string
 }
 
-func CreateArchiveExec(settings BorgSettings, ArchiveName string, Settings CreateArchiveSettings, cmdSource *exec.Cmd) (*exec.Cmd, error) {
-	Settings.AdditionalArgs = append(Settings.AdditionalArgs, "--content-from-command")
+// CreateArchiveStdin creates an archive from the data written to the standard input of the returned process.
+func CreateArchiveStdin(settings BorgSettings, ArchiveName string, Settings CreateArchiveSettings) (*exec.Cmd, error) {
 	cmd, err := CreateArchive(settings, ArchiveName, Settings)
 	if err != nil {
 		return nil, err
 	}
 
-	cmd.Args = append(cmd.Args, "--")
-	cmd.Args = append(cmd.Args, cmdSource.Args...)
+	cmd.Args = append(cmd.Args, "-")
 	return cmd, nil
 }
 
@@ -50,22 +200,28 @@ func CreateArchive(settings BorgSettings, ArchiveName string, Settings CreateArc
 	if Settings.Comment != "" {
 		args = append(args, "--comment", Settings.Comment)
 	}
+	if Settings.JSON {
+		args = append(args, "--json")
+	}
 	args = append(args, Settings.AdditionalArgs...)
 	args = append(args, settings.Repository+"::"+ArchiveName)
 
-	cmd := exec.Command("borg", args...)
-	if cmd.Err != nil {
-		return nil, fmt.Errorf("archive creation process failed: %v", cmd.Err)
-	}
-	cmd.Env = os.Environ()
+	return newCommand(settings, "archive creation", args)
+}
 
-	// Will be escaped by cmd.Exec
-	cmd.Env = append(cmd.Env, "BORG_PASSPHRASE="+settings.Passphrase)
+// PruneByPrefix prunes the archives whose name starts with ArchivePrefix.
+// It lists the archives it keeps and deletes, its output can be parsed with ParsePruneList.
+func PruneByPrefix(settings BorgSettings, ArchivePrefix string) (*exec.Cmd, error) {
+	return pruneByPrefix(settings, ArchivePrefix, []string{"--list"})
+}
 
-	return cmd, nil
+// PruneByPrefixDryRun lists what PruneByPrefix would keep and delete, without deleting anything.
+// Its output can be parsed with ParsePruneList.
+func PruneByPrefixDryRun(settings BorgSettings, ArchivePrefix string) (*exec.Cmd, error) {
+	return pruneByPrefix(settings, ArchivePrefix, []string{"--dry-run", "--list"})
 }
 
-func PruneByPrefix(settings BorgSettings, ArchivePrefix string) (*exec.Cmd, error) {
+func pruneByPrefix(settings BorgSettings, ArchivePrefix string, AdditionalArgs []string) (*exec.Cmd, error) {
 	if !settings.Prune.Enabled {
 		return nil, errors.New("prune is disabled in the current borg configuration")
 	}
@@ -73,6 +229,7 @@ func PruneByPrefix(settings BorgSettings, ArchivePrefix string) (*exec.Cmd, erro
 	args := []string{
 		"prune",
 	}
+	args = append(args, AdditionalArgs...)
 
 	if settings.RemotePath != "" {
 		args = append(args, "--remote-path", settings.RemotePath)
@@ -106,14 +263,32 @@ func PruneByPrefix(settings BorgSettings, ArchivePrefix string) (*exec.Cmd, erro
 	args = append(args, "--glob-archives", ArchivePrefix+"*")
 	args = append(args, settings.Repository)
 
-	cmd := exec.Command("borg", args...)
-	if cmd.Err != nil {
-		return nil, fmt.Errorf("archive pruning process failed: %v", cmd.Err)
+	return newCommand(settings, "archive pruning", args)
+}
+
+// ParsePruneList reads the archive list printed by "borg prune --list".
+func ParsePruneList(output string) PruneList {
+	if regexPruneKeep == nil {
+		// i.e. "Keeping archive (rule: daily #1):", the rule has a colon of its own
+		regexPruneKeep = regexp.MustCompile(`^Keeping (checkpoint )?archive(?: \([^)]*\))?:\s+(\S+)`)
 	}
-	cmd.Env = os.Environ()
-	// Will be escaped by cmd.Exec
-	cmd.Env = append(cmd.Env, "BORG_PASSPHRASE="+settings.Passphrase)
-	return cmd, nil
+	if regexPruneDelete == nil {
+		regexPruneDelete = regexp.MustCompile(`^(?:Would prune|Pruning archive(?: \([^)]*\))?):\s+(\S+)`)
+	}
+
+	list := PruneList{}
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if m := regexPruneKeep.FindStringSubmatch(line); m != nil {
+			// Checkpoints are partial archives, they don't count as kept history
+			if m[1] == "" {
+				list.Keep = append(list.Keep, m[2])
+			}
+		} else if m := regexPruneDelete.FindStringSubmatch(line); m != nil {
+			list.Delete = append(list.Delete, m[1])
+		}
+	}
+	return list
 }
 
 func Compact(settings BorgSettings) (*exec.Cmd, error) {
@@ -125,20 +300,207 @@ func Compact(settings BorgSettings) (*exec.Cmd, error) {
 		"compact",
 	}
 
+	if settings.Prune.CompactThreshold > 100 {
+		return nil, fmt.Errorf("invalid compact threshold: %v", settings.Prune.CompactThreshold)
+	} else if settings.Prune.CompactThreshold > 0 {
+		args = append(args, "--threshold", strconv.FormatUint(settings.Prune.CompactThreshold, 10))
+	}
+
 	if settings.RemotePath != "" {
 		args = append(args, "--remote-path", settings.RemotePath)
 	}
 
 	args = append(args, settings.Repository)
 
-	cmd := exec.Command("borg", args...)
-	if cmd.Err != nil {
-		return nil, fmt.Errorf("archive compacting process failed: %v", cmd.Err)
+	return newCommand(settings, "archive compacting", args)
+}
+
+func Check(settings BorgSettings) (*exec.Cmd, error) {
+	if !settings.Check.Enabled {
+		return nil, errors.New("check is disabled in the current borg configuration")
 	}
-	cmd.Env = os.Environ()
-	// Will be escaped by cmd.Exec
-	cmd.Env = append(cmd.Env, "BORG_PASSPHRASE="+settings.Passphrase)
-	return cmd, nil
+
+	args := []string{
+		"check",
+		"--info",
+	}
+
+	if settings.RemotePath != "" {
+		args = append(args, "--remote-path", settings.RemotePath)
+	}
+
+	switch settings.Check.Mode {
+	case CHK_Full, "":
+	case CHK_Repository:
+		args = append(args, "--repository-only")
+	case CHK_Archives:
+		args = append(args, "--archives-only")
+	default:
+		return nil, fmt.Errorf("invalid borg check mode: %v", string(settings.Check.Mode))
+	}
+
+	if settings.Check.VerifyData {
+		if settings.Check.Mode == CHK_Repository {
+			return nil, errors.New("borg check can't verify data with a repository-only check")
+		}
+		args = append(args, "--verify-data")
+	}
+
+	if settings.Check.MaxDuration > 0 {
+		if settings.Check.Mode != CHK_Repository {
+			return nil, errors.New("borg check only supports a max duration with a repository-only check")
+		}
+		args = append(args, "--max-duration", strconv.FormatUint(settings.Check.MaxDuration, 10))
+	}
+
+	args = append(args, settings.Repository)
+
+	return newCommand(settings, "repository check", args)
+}
+
+// ParseCheckOutput goes through the log lines of a "borg check --info" run, as forwarded by a LogCollector.
+// The messages borg logged as errors or warnings are the problems, its informational messages are left out.
+func ParseCheckOutput(output string) CheckResult {
+	if regexCheckPartial == nil {
+		regexCheckPartial = regexp.MustCompile(`(?i)finished partial segment check`)
+	}
+
+	result := CheckResult{}
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if regexCheckPartial.MatchString(line) {
+			result.Partial = true
+		}
+		if problem, ok := strings.CutPrefix(line, LogErrorPrefix); ok {
+			result.Problems = append(result.Problems, problem)
+		} else if problem, ok := strings.CutPrefix(line, LogWarningPrefix); ok {
+			result.Problems = append(result.Problems, problem)
+		}
+	}
+	return result
+}
+
+// ParseCreateStats reads the output of "borg create --json".
+func ParseCreateStats(output []byte) (CreateStats, error) {
+	var result struct {
+		Archive struct {
+			Stats CreateStats `json:"stats"`
+		} `json:"archive"`
+	}
+	if err := json.Unmarshal(output, &result); err != nil {
+		return CreateStats{}, fmt.Errorf("cannot parse borg create stats: %w", err)
+	}
+	return result.Archive.Stats, nil
+}
+
+// ListArchives returns the names of the archives matching the glob pattern.
+func ListArchives(settings BorgSettings, Glob string) ([]string, error) {
+	args := []string{
+		"list",
+		"--short",
+	}
+
+	if settings.RemotePath != "" {
+		args = append(args, "--remote-path", settings.RemotePath)
+	}
+	if Glob != "" {
+		args = append(args, "--glob-archives", Glob)
+	}
+
+	args = append(args, settings.Repository)
+
+	cmd, err := newCommand(settings, "archive listing", args)
+	if err != nil {
+		return nil, err
+	}
+
+	stderr := NewLogCollector(nil)
+	cmd.Stderr = stderr
+	output, err := cmd.Output()
+	stderr.Close()
+	if err != nil {
+		return nil, fmt.Errorf("borg returned an error: %w", stderr.Err(err))
+	}
+
+	archives := []string{}
+	for _, line := range strings.Split(string(output), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			archives = append(archives, line)
+		}
+	}
+	return archives, nil
+}
+
+func InitRepository(settings BorgSettings, Settings InitRepositorySettings) (*exec.Cmd, error) {
+	if !Settings.Encryption.IsValid() {
+		return nil, fmt.Errorf("invalid borg encryption mode: %v", string(Settings.Encryption))
+	}
+
+	args := []string{
+		"init",
+		"--encryption", string(Settings.Encryption),
+	}
+
+	if settings.RemotePath != "" {
+		args = append(args, "--remote-path", settings.RemotePath)
+	}
+
+	args = append(args, Settings.AdditionalArgs...)
+	args = append(args, settings.Repository)
+
+	return newCommand(settings, "repository initialization", args)
+}
+
+func ExportKey(settings BorgSettings, Path string, Paper bool) (*exec.Cmd, error) {
+	args := []string{
+		"key",
+		"export",
+	}
+
+	if settings.RemotePath != "" {
+		args = append(args, "--remote-path", settings.RemotePath)
+	}
+	if Paper {
+		args = append(args, "--paper")
+	}
+
+	args = append(args, settings.Repository, Path)
+
+	return newCommand(settings, "key export", args)
+}
+
+// RepositoryExists asks borg for the latest archive of the repository.
+// Only an explicit Repository.DoesNotExist answer is reported as a missing repository,
+// every other failure is returned as an error.
+func RepositoryExists(settings BorgSettings) (bool, error) {
+	args := []string{
+		"list",
+		"--short",
+		"--last", "1",
+	}
+
+	if settings.RemotePath != "" {
+		args = append(args, "--remote-path", settings.RemotePath)
+	}
+
+	args = append(args, settings.Repository)
+
+	cmd, err := newCommand(settings, "repository listing", args)
+	if err != nil {
+		return false, err
+	}
+
+	stderr := NewLogCollector(nil)
+	cmd.Stderr = stderr
+	err = cmd.Run()
+	stderr.Close()
+	if err = stderr.Err(err); errors.Is(err, ErrRepositoryDoesNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("borg returned an error: %w", err)
+	}
+
+	return true, nil
 }
 
 func GetVersion() (*gv.Version, error) {
@@ -0,0 +1,285 @@
+package BorgCLI
+
+import (
+	"bytes"
+	"errors"
+	"os/exec"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+// collect feeds "--log-json" lines to a LogCollector, and returns what it forwarded.
+func collect(t *testing.T, lines string) (*LogCollector, string) {
+	t.Helper()
+	var forwarded bytes.Buffer
+	collector := NewLogCollector(&forwarded)
+	if _, err := collector.Write([]byte(lines)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := collector.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return collector, forwarded.String()
+}
+
+func TestParseCheckOutput(t *testing.T) {
+	tests := []struct {
+		name     string
+		log      string
+		partial  bool
+		problems []string
+	}{
+		{
+			name: "clean full check",
+			log: `{"type": "log_message", "time": 1.0, "levelname": "INFO", "name": "borg.repository", "message": "Starting repository check"}
+{"type": "log_message", "time": 1.0, "levelname": "INFO", "name": "borg.repository", "message": "finished segment check at segment 1234"}
+{"type": "log_message", "time": 1.0, "levelname": "INFO", "name": "borg.repository", "message": "Starting repository index check"}
+{"type": "log_message", "time": 1.0, "levelname": "INFO", "name": "borg.repository", "message": "Index object count match."}
+{"type": "log_message", "time": 1.0, "levelname": "INFO", "name": "borg.repository", "message": "Finished full repository check, no problems found."}
+{"type": "log_message", "time": 1.0, "levelname": "INFO", "name": "borg.archive", "message": "Starting archive consistency check..."}
+{"type": "log_message", "time": 1.0, "levelname": "INFO", "name": "borg.archive", "message": "Analyzing archive pve-qemu-100-2024_01_02-03_00_00.vma (1/1)"}
+{"type": "log_message", "time": 1.0, "levelname": "INFO", "name": "borg.archive", "message": "Archive consistency check complete, no problems found."}
+`,
+		},
+		{
+			name: "partial check",
+			log: `{"type": "log_message", "time": 1.0, "levelname": "INFO", "name": "borg.repository", "message": "Starting partial repository check"}
+{"type": "log_message", "time": 1.0, "levelname": "INFO", "name": "borg.repository", "message": "finished partial segment check, last segment checked is 42"}
+`,
+			partial: true,
+		},
+		{
+			name: "damaged repository",
+			log: `{"type": "log_message", "time": 1.0, "levelname": "INFO", "name": "borg.repository", "message": "Starting repository check"}
+{"type": "log_message", "time": 1.0, "levelname": "ERROR", "name": "borg.repository", "message": "Index object count mismatch."}
+{"type": "log_message", "time": 1.0, "levelname": "WARNING", "name": "borg.repository", "message": "committed index: 1 objects"}
+{"type": "log_message", "time": 1.0, "levelname": "ERROR", "name": "borg.repository", "message": "Finished full repository check, errors found."}
+`,
+			problems: []string{
+				"Index object count mismatch.",
+				"committed index: 1 objects",
+				"Finished full repository check, errors found.",
+			},
+		},
+		{
+			name: "ssh output isn't a problem by itself",
+			log: `Remote: Warning: Permanently added 'backup' (ED25519) to the list of known hosts.
+{"type": "log_message", "time": 1.0, "levelname": "INFO", "name": "borg.repository", "message": "Starting repository check"}
+`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, output := collect(t, test.log)
+			result := ParseCheckOutput(output)
+			if result.Partial != test.partial {
+				t.Errorf("Partial = %v, want %v", result.Partial, test.partial)
+			}
+			if !slices.Equal(result.Problems, test.problems) {
+				t.Errorf("Problems = %q, want %q", result.Problems, test.problems)
+			}
+		})
+	}
+}
+
+// exitError returns the error of a process that exited with code.
+func exitError(t *testing.T, code int) error {
+	t.Helper()
+	err := exec.Command("sh", "-c", "exit "+strconv.Itoa(code)).Run()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != code {
+		t.Fatalf("cannot get exit code %v: %v", code, err)
+	}
+	return err
+}
+
+func TestLogCollector(t *testing.T) {
+	tests := []struct {
+		name      string
+		log       string
+		exitCode  int
+		forwarded string
+		// The fields of the *Error returned by Err
+		msgID    MsgID
+		message  string
+		warnings []string
+		warning  bool
+		is       error
+	}{
+		{
+			name: "lock timeout",
+			log: `{"type": "log_message", "time": 1.0, "levelname": "INFO", "name": "borg.archiver", "message": "Creating archive"}
+{"type": "log_message", "time": 1.0, "levelname": "ERROR", "name": "borg.archiver", "message": "Failed to create/acquire the lock /repo/lock.exclusive (timeout).", "msgid": "LockTimeout"}
+`,
+			exitCode: 2,
+			forwarded: `Creating archive
+ERROR: Failed to create/acquire the lock /repo/lock.exclusive (timeout).
+`,
+			msgID:   MSG_LockTimeout,
+			message: "Failed to create/acquire the lock /repo/lock.exclusive (timeout).",
+			is:      ErrLockTimeout,
+		},
+		{
+			name: "the error with a msgid wins",
+			log: `{"type": "log_message", "time": 1.0, "levelname": "ERROR", "name": "borg.repository", "message": "Remote: Borg server error"}
+{"type": "log_message", "time": 1.0, "levelname": "ERROR", "name": "borg.archiver", "message": "Repository /repo does not exist.", "msgid": "Repository.DoesNotExist"}
+{"type": "log_message", "time": 1.0, "levelname": "ERROR", "name": "borg.archiver", "message": "Traceback follows"}
+`,
+			exitCode: 2,
+			forwarded: `ERROR: Remote: Borg server error
+ERROR: Repository /repo does not exist.
+ERROR: Traceback follows
+`,
+			msgID:   MSG_RepositoryDoesNotExist,
+			message: "Repository /repo does not exist.",
+			is:      ErrRepositoryDoesNotExist,
+		},
+		{
+			name: "repository already exists",
+			log: `{"type": "log_message", "time": 1.0, "levelname": "ERROR", "name": "borg.archiver", "message": "A repository already exists at /repo.", "msgid": "Repository.AlreadyExists"}
+`,
+			exitCode:  2,
+			forwarded: "ERROR: A repository already exists at /repo.\n",
+			msgID:     MSG_RepositoryAlreadyExists,
+			message:   "A repository already exists at /repo.",
+			is:        ErrRepositoryAlreadyExists,
+		},
+		{
+			name: "warnings only",
+			log: `{"type": "progress_percent", "operation": 1, "msgid": "extract", "finished": false, "current": 1, "total": 2}
+{"type": "log_message", "time": 1.0, "levelname": "WARNING", "name": "borg.archiver", "message": "/etc/shadow: open: [Errno 13] Permission denied"}
+{"type": "log_message", "time": 1.0, "levelname": "INFO", "name": "borg.archiver", "message": "Archive created"}
+`,
+			exitCode: 1,
+			forwarded: `WARNING: /etc/shadow: open: [Errno 13] Permission denied
+Archive created
+`,
+			warnings: []string{"/etc/shadow: open: [Errno 13] Permission denied"},
+			warning:  true,
+		},
+		{
+			name:      "ssh only",
+			log:       "ssh: connect to host backup port 22: Connection refused\nConnection closed by remote host",
+			exitCode:  2,
+			forwarded: "ssh: connect to host backup port 22: Connection refused\nConnection closed by remote host\n",
+			message:   "Connection closed by remote host",
+		},
+		{
+			name: "ssh output isn't the error when borg logged one",
+			log: `Remote: Warning: Permanently added 'backup' (ED25519) to the list of known hosts.
+{"type": "log_message", "time": 1.0, "levelname": "ERROR", "name": "borg.archiver", "message": "passphrase supplied in BORG_PASSPHRASE is incorrect.", "msgid": "PassphraseWrong"}
+`,
+			exitCode: 2,
+			forwarded: `Remote: Warning: Permanently added 'backup' (ED25519) to the list of known hosts.
+ERROR: passphrase supplied in BORG_PASSPHRASE is incorrect.
+`,
+			msgID:   MSG_PassphraseWrong,
+			message: "passphrase supplied in BORG_PASSPHRASE is incorrect.",
+			is:      ErrPassphraseWrong,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			collector, forwarded := collect(t, test.log)
+			if forwarded != test.forwarded {
+				t.Errorf("forwarded %q, want %q", forwarded, test.forwarded)
+			}
+			if !slices.Equal(collector.Warnings(), test.warnings) {
+				t.Errorf("Warnings = %q, want %q", collector.Warnings(), test.warnings)
+			}
+
+			err := collector.Err(exitError(t, test.exitCode))
+			var borgErr *Error
+			if !errors.As(err, &borgErr) {
+				t.Fatalf("Err = %#v, want an *Error", err)
+			}
+			if borgErr.ExitCode != test.exitCode || borgErr.MsgID != test.msgID || borgErr.Message != test.message {
+				t.Errorf("Err = %v, %q, %q, want %v, %q, %q", borgErr.ExitCode, borgErr.MsgID, borgErr.Message, test.exitCode, test.msgID, test.message)
+			}
+			if borgErr.IsWarning() != test.warning {
+				t.Errorf("IsWarning = %v, want %v", borgErr.IsWarning(), test.warning)
+			}
+
+			var exitErr *exec.ExitError
+			if !errors.As(err, &exitErr) {
+				t.Error("Err doesn't wrap the *exec.ExitError")
+			}
+			for _, sentinel := range []error{ErrLockTimeout, ErrLockFailed, ErrConnectionClosed, ErrPassphraseWrong, ErrRepositoryDoesNotExist, ErrRepositoryAlreadyExists} {
+				if got, want := errors.Is(err, sentinel), sentinel == test.is; got != want {
+					t.Errorf("errors.Is(err, %v) = %v, want %v", sentinel, got, want)
+				}
+			}
+		})
+	}
+
+	t.Run("success", func(t *testing.T) {
+		collector, _ := collect(t, `{"type": "log_message", "time": 1.0, "levelname": "WARNING", "name": "borg", "message": "ignored"}`)
+		if err := collector.Err(nil); err != nil {
+			t.Errorf("Err(nil) = %v", err)
+		}
+	})
+}
+
+func TestParsePruneList(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   PruneList
+	}{
+		{
+			name: "dry run",
+			output: `Keeping archive (rule: daily #1):        pve1-qemu-100-2024_01_03-03_00_00.vma Wed, 2024-01-03 03:00:00 [aa]
+Keeping archive (rule: daily[oldest] #2): pve1-qemu-100-2024_01_02-03_00_00.vma Tue, 2024-01-02 03:00:00 [bb]
+Keeping checkpoint archive:               pve1-qemu-100-2024_01_04-03_00_00.vma.checkpoint Thu, 2024-01-04 03:00:00 [cc]
+Would prune:                              pve1-qemu-100-2024_01_01-03_00_00.vma Mon, 2024-01-01 03:00:00 [dd]
+Would prune:                              pve1-qemu-100-2023_12_31-03_00_00.vma Sun, 2023-12-31 03:00:00 [ee]
+`,
+			want: PruneList{
+				Keep:   []string{"pve1-qemu-100-2024_01_03-03_00_00.vma", "pve1-qemu-100-2024_01_02-03_00_00.vma"},
+				Delete: []string{"pve1-qemu-100-2024_01_01-03_00_00.vma", "pve1-qemu-100-2023_12_31-03_00_00.vma"},
+			},
+		},
+		{
+			name: "prune",
+			output: `Keeping archive (rule: within #1):       pve1-lxc-101-2024_01_03-03_00_00.tar Wed, 2024-01-03 03:00:00 [aa]
+Pruning archive (1/2):                    pve1-lxc-101-2024_01_02-03_00_00.tar Tue, 2024-01-02 03:00:00 [bb]
+Pruning archive (2/2):                    pve1-lxc-101-2024_01_01-03_00_00.tar Mon, 2024-01-01 03:00:00 [cc]
+`,
+			want: PruneList{
+				Keep:   []string{"pve1-lxc-101-2024_01_03-03_00_00.tar"},
+				Delete: []string{"pve1-lxc-101-2024_01_02-03_00_00.tar", "pve1-lxc-101-2024_01_01-03_00_00.tar"},
+			},
+		},
+		{
+			name: "borg 1.1",
+			output: `Keeping archive: pve1-qemu-100-2024_01_03-03_00_00.vma Wed, 2024-01-03 03:00:00 [aa]
+Pruning archive: pve1-qemu-100-2024_01_02-03_00_00.vma Tue, 2024-01-02 03:00:00 [bb]
+`,
+			want: PruneList{
+				Keep:   []string{"pve1-qemu-100-2024_01_03-03_00_00.vma"},
+				Delete: []string{"pve1-qemu-100-2024_01_02-03_00_00.vma"},
+			},
+		},
+		{
+			name: "other lines",
+			output: `Remote: Warning: Permanently added 'backup' (ED25519) to the list of known hosts.
+WARNING: some warning
+`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			list := ParsePruneList(test.output)
+			if !slices.Equal(list.Keep, test.want.Keep) {
+				t.Errorf("Keep = %q, want %q", list.Keep, test.want.Keep)
+			}
+			if !slices.Equal(list.Delete, test.want.Delete) {
+				t.Errorf("Delete = %q, want %q", list.Delete, test.want.Delete)
+			}
+		})
+	}
+}
@@ -1,8 +1,34 @@
 package BorgCLI
 
-type BorgPruneSettings struct {
-	Enabled      bool
-	Compact      bool
+import "strings"
+
+type EncryptionMode string
+
+const (
+	ENC_None                EncryptionMode = "none"
+	ENC_Authenticated       EncryptionMode = "authenticated"
+	ENC_AuthenticatedBlake2 EncryptionMode = "authenticated-blake2"
+	ENC_Repokey             EncryptionMode = "repokey"
+	ENC_RepokeyBlake2       EncryptionMode = "repokey-blake2"
+	ENC_Keyfile             EncryptionMode = "keyfile"
+	ENC_KeyfileBlake2       EncryptionMode = "keyfile-blake2"
+)
+
+func (e EncryptionMode) IsValid() bool {
+	switch e {
+	case ENC_None, ENC_Authenticated, ENC_AuthenticatedBlake2, ENC_Repokey, ENC_RepokeyBlake2, ENC_Keyfile, ENC_KeyfileBlake2:
+		return true
+	}
+	return false
+}
+
+// HasKey reports whether the encryption mode produces a key that can be exported.
+func (e EncryptionMode) HasKey() bool {
+	return e != ENC_None
+}
+
+// BorgKeepSettings is the keep-policy of a prune.
+type BorgKeepSettings struct {
 	KeepWithin   string
 	KeepLast     uint64
 	KeepMinutely uint64
@@ -13,10 +39,144 @@ type BorgPruneSettings struct {
 	KeepYearly   uint64
 }
 
+// IsEmpty reports whether the keep-policy has no rules, borg refuses to prune without any.
+func (k BorgKeepSettings) IsEmpty() bool {
+	return k == BorgKeepSettings{}
+}
+
+type BorgPruneSettings struct {
+	Enabled bool
+	Compact bool
+	// Percentage of freeable space a segment needs to be rewritten, 0 uses borg's default
+	CompactThreshold uint64
+	CompactEveryDays uint64
+	// Guards, 0 disables them
+	MinRemaining uint64
+	MaxDeletions uint64
+	BorgKeepSettings
+}
+
+type CheckMode string
+
+const (
+	CHK_Full       CheckMode = "full"
+	CHK_Repository CheckMode = "repository"
+	CHK_Archives   CheckMode = "archives"
+)
+
+type BorgCheckSettings struct {
+	Enabled     bool
+	AfterJob    bool
+	EveryDays   uint64
+	Mode        CheckMode
+	VerifyData  bool
+	MaxDuration uint64
+}
+
 type BorgSettings struct {
 	Repository string
 	RemotePath string
 	Passphrase string
 
 	Prune BorgPruneSettings
+	Check BorgCheckSettings
+}
+
+type InitRepositorySettings struct {
+	Encryption     EncryptionMode
+	AdditionalArgs []string
+}
+
+type CheckResult struct {
+	Partial  bool
+	Problems []string
+}
+
+// CreateStats are the sizes of a new archive, DeduplicatedSize is what it added to the repository.
+type CreateStats struct {
+	OriginalSize     uint64 `json:"original_size"`
+	CompressedSize   uint64 `json:"compressed_size"`
+	DeduplicatedSize uint64 `json:"deduplicated_size"`
+}
+
+type PruneList struct {
+	Keep   []string
+	Delete []string
+}
+
+// MsgID identifies a borg error in its "--log-json" output.
+type MsgID string
+
+const (
+	MSG_LockTimeout              MsgID = "LockTimeout"
+	MSG_LockFailed               MsgID = "LockFailed"
+	MSG_ConnectionClosed         MsgID = "ConnectionClosed"
+	MSG_ConnectionClosedWithHint MsgID = "ConnectionClosedWithHint"
+	MSG_PassphraseWrong          MsgID = "PassphraseWrong"
+	MSG_RepositoryDoesNotExist   MsgID = "Repository.DoesNotExist"
+	MSG_RepositoryAlreadyExists  MsgID = "Repository.AlreadyExists"
+	MSG_RepositoryCheckNeeded    MsgID = "Repository.CheckNeeded"
+	MSG_InsufficientFreeSpace    MsgID = "Repository.InsufficientFreeSpaceError"
+	MSG_StorageQuotaExceeded     MsgID = "Repository.StorageQuotaExceeded"
+	MSG_ArchiveAlreadyExists     MsgID = "Archive.AlreadyExists"
+)
+
+// LogMessage is a line of "borg --log-json" output.
+type LogMessage struct {
+	Type      string `json:"type"`
+	LevelName string `json:"levelname"`
+	Name      string `json:"name"`
+	Message   string `json:"message"`
+	MsgID     MsgID  `json:"msgid"`
+}
+
+// Error is a failed borg process, along with what borg logged about it.
+// Use errors.As to read it, or errors.Is with one of the Err variables to look for a msgid.
+type Error struct {
+	// The msgid and message of the error logged by borg, empty when borg logged none (i.e. ssh failed)
+	MsgID   MsgID
+	Message string
+	// 1 only means that borg logged warnings, see IsWarning
+	ExitCode int
+	Warnings []string
+	Err      error
+}
+
+var (
+	ErrLockTimeout             = &Error{MsgID: MSG_LockTimeout}
+	ErrLockFailed              = &Error{MsgID: MSG_LockFailed}
+	ErrConnectionClosed        = &Error{MsgID: MSG_ConnectionClosed}
+	ErrPassphraseWrong         = &Error{MsgID: MSG_PassphraseWrong}
+	ErrRepositoryDoesNotExist  = &Error{MsgID: MSG_RepositoryDoesNotExist}
+	ErrRepositoryAlreadyExists = &Error{MsgID: MSG_RepositoryAlreadyExists}
+)
+
+func (e *Error) Error() string {
+	switch {
+	case e.Message != "" && e.MsgID != "":
+		return e.Message + " (" + string(e.MsgID) + ")"
+	case e.Message != "":
+		return e.Message
+	case e.IsWarning() && len(e.Warnings) > 0:
+		return "warning: " + strings.Join(e.Warnings, "; ")
+	case e.Err != nil:
+		return e.Err.Error()
+	default:
+		return string(e.MsgID)
+	}
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is matches an Error with the same msgid, i.e. ErrLockTimeout.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.MsgID != "" && t.MsgID == e.MsgID
+}
+
+// IsWarning reports whether borg finished its work, only logging warnings.
+func (e *Error) IsWarning() bool {
+	return e.ExitCode == 1 && e.MsgID == ""
 }
@@ -0,0 +1,214 @@
+package Job
+
+import (
+	"borgmox/BorgCLI"
+	"borgmox/ProxmoxCLI"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseMaxAge reads the MaxAge of a job, zero when it's empty.
+func parseMaxAge(maxAge string) (time.Duration, error) {
+	if maxAge == "" {
+		return 0, nil
+	}
+	if days, ok := strings.CutSuffix(maxAge, "d"); ok {
+		if n, err := strconv.ParseUint(days, 10, 32); err == nil && n > 0 {
+			return time.Duration(n) * 24 * time.Hour, nil
+		}
+		return 0, fmt.Errorf("invalid MaxAge %v", maxAge)
+	}
+	d, err := time.ParseDuration(maxAge)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid MaxAge %v", maxAge)
+	}
+	return d, nil
+}
+
+// formatAge prints an archive age in days and hours, or minutes when it's recent.
+func formatAge(age time.Duration) string {
+	days := age / (24 * time.Hour)
+	hours := (age % (24 * time.Hour)) / time.Hour
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%vd%vh", int64(days), int64(hours))
+	case hours > 0:
+		return fmt.Sprintf("%vh%vm", int64(hours), int64(age%time.Hour/time.Minute))
+	default:
+		return fmt.Sprintf("%vm", int64(age/time.Minute))
+	}
+}
+
+// newestArchives finds the newest archive of every archive prefix in a repository.
+func newestArchives(repository BorgCLI.BorgSettings, naming archiveNaming) (map[string]time.Time, error) {
+	archives, err := BorgCLI.ListArchives(repository, naming.listGlob())
+	if err != nil {
+		return nil, err
+	}
+
+	newest := map[string]time.Time{}
+	for _, archive := range archives {
+		prefix, _, _, ok := naming.parse(archive)
+		if !ok {
+			continue
+		}
+		ts, ok := naming.archiveTime(prefix, archive)
+		if !ok {
+			continue
+		}
+		if last, ok := newest[prefix]; !ok || ts.After(last) {
+			newest[prefix] = ts
+		}
+	}
+	return newest, nil
+}
+
+// auditJob looks for the VMs/LXCs of a job whose newest archive is missing, or older than MaxAge, in any repository.
+func (s *JobData) auditJob(jobName string, js BackupJobSettings, machines map[uint64]BackupJobData, now time.Time, out io.Writer, result *JobResult) {
+	maxAge, _ := parseMaxAge(js.MaxAge)
+	naming, err := newArchiveNaming(jobName, js)
+	if err != nil {
+		result.Error = err
+		return
+	}
+
+	stale := map[uint64][]string{}
+	var repositoryErrors []error
+	for _, repository := range js.repositories() {
+		fmt.Fprintf(out, "  %v\n", repository.Repository)
+
+		newest, err := newestArchives(repository, naming)
+		if err != nil {
+			fmt.Fprintf(out, "    ERROR: %v\n", err)
+			jobLogger(jobName, NPH_Audit).Error("Cannot list the archives", "repository", repository.Repository, "error", err)
+			repositoryErrors = append(repositoryErrors, fmt.Errorf("%v: cannot list archives: %w", repository.Repository, err))
+			continue
+		}
+
+		for _, vmid := range sortedMapKeys(machines) {
+			machine := machines[vmid]
+			guest := fmt.Sprintf("%v %v (%v)", machineTypeName(machine.Info.Type), machine.Info.Name, vmid)
+
+			last, ok := newest[machine.archivePrefix()]
+			if !ok {
+				fmt.Fprintf(out, "    %v: no archive  MISSING\n", guest)
+				stale[vmid] = append(stale[vmid], fmt.Sprintf("no archive in %v", repository.Repository))
+				continue
+			}
+
+			age := now.Sub(last)
+			if maxAge > 0 && age > maxAge {
+				fmt.Fprintf(out, "    %v: %v, %v ago  STALE\n", guest, last.Format(time.RFC3339), formatAge(age))
+				stale[vmid] = append(stale[vmid], fmt.Sprintf("last backup in %v is %v old, MaxAge is %v", repository.Repository, formatAge(age), js.MaxAge))
+				continue
+			}
+			fmt.Fprintf(out, "    %v: %v, %v ago\n", guest, last.Format(time.RFC3339), formatAge(age))
+		}
+	}
+
+	for vmid, problems := range stale {
+		result.FailedAudit[vmid] = errors.New(strings.Join(problems, "; "))
+		guestLogger(jobName, NPH_Audit, machines[vmid].Info).Warn("Backup is not recent enough", "error", result.FailedAudit[vmid])
+	}
+	result.Error = errors.Join(repositoryErrors...)
+}
+
+// RunAudit prints the newest archive of every VM/LXC of the jobs, and sends a single notification for the whole audit.
+// Nothing is backed up or modified, so it can run on its own schedule.
+func (s *JobData) RunAudit(options AuditOptions, out io.Writer) map[string]JobResult {
+	jobResults := make(map[string]JobResult, len(s.BackupJobs))
+	skippedMachines := make(map[uint64]struct{}, 64)
+	now := time.Now()
+
+	// The VMs/LXCs of every job, along with their problems in each job
+	event := NotificationEvent{
+		Phase:    NPH_Audit,
+		Outcome:  NO_Success,
+		Machines: map[uint64]ProxmoxCLI.MachineInfo{},
+		Failed:   map[uint64]error{},
+	}
+	auditedJobs := []string{}
+
+	for _, jobName := range sortedJobNames(s.BackupJobs) {
+		if len(options.Jobs) > 0 && !slices.Contains(options.Jobs, jobName) {
+			continue
+		}
+		jobSettings := s.BackupJobs[jobName]
+
+		if jobSettings.MaxAge != "" {
+			fmt.Fprintf(out, "Backup Job %v (MaxAge %v)\n", jobName, jobSettings.MaxAge)
+		} else {
+			fmt.Fprintf(out, "Backup Job %v\n", jobName)
+		}
+
+		auditedJobs = append(auditedJobs, jobName)
+
+		machines, err := s.resolveMachines(jobName, jobSettings, skippedMachines)
+		if err != nil {
+			fmt.Fprintf(out, "  ERROR: %v\n\n", err)
+			jobLogger(jobName, NPH_Audit).Error("Audit failed", "error", err)
+			jobResults[jobName] = JobResult{
+				Error: err,
+			}
+			event.Error = errors.Join(event.Error, fmt.Errorf("Backup Job %v: %w", jobName, err))
+			continue
+		}
+
+		result := JobResult{
+			Machines:    make(map[uint64]ProxmoxCLI.MachineInfo, len(machines)),
+			AuditRan:    true,
+			FailedAudit: make(map[uint64]error, len(machines)),
+		}
+		for vmid, machine := range machines {
+			result.Machines[vmid] = machine.Info
+		}
+
+		s.auditJob(jobName, jobSettings, machines, now, out, &result)
+		fmt.Fprintln(out)
+
+		for vmid, info := range result.Machines {
+			event.Machines[vmid] = info
+		}
+		for vmid, err := range result.FailedAudit {
+			err = fmt.Errorf("Backup Job %v: %w", jobName, err)
+			if previous, ok := event.Failed[vmid]; ok {
+				err = fmt.Errorf("%w; %w", previous, err)
+			}
+			event.Failed[vmid] = err
+		}
+		if result.Error != nil {
+			event.Error = errors.Join(event.Error, fmt.Errorf("Backup Job %v: %w", jobName, result.Error))
+		}
+
+		jobResults[jobName] = result
+	}
+
+	if len(auditedJobs) > 0 {
+		succeeded := map[uint64]struct{}{}
+		for vmid := range event.Machines {
+			if _, ok := event.Failed[vmid]; !ok {
+				succeeded[vmid] = struct{}{}
+			}
+		}
+		event.Succeeded = sortedVMIDs(succeeded)
+		if event.Error != nil || len(event.Failed) > 0 {
+			event.Outcome = NO_Failure
+		}
+		s.notifyRun(auditedJobs, event)
+	}
+
+	for _, jobName := range options.Jobs {
+		if _, ok := s.BackupJobs[jobName]; !ok {
+			jobResults[jobName] = JobResult{
+				Error: fmt.Errorf("backup job %v does not exist", jobName),
+			}
+		}
+	}
+
+	return jobResults
+}
@@ -3,9 +3,12 @@ package Job
 import (
 	"borgmox/ProxmoxCLI"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"os"
 	"sort"
-	"strconv"
+	"strings"
+	"time"
 )
 
 func sortedMapKeys(m map[uint64]BackupJobData) []uint64 {
@@ -22,218 +25,513 @@ func sortedMapKeys(m map[uint64]BackupJobData) []uint64 {
 	return keys
 }
 
+const (
+	// A backup that failed in every repository because borg couldn't lock them is attempted again.
+	// Other failures, like a lost connection, may happen mid-stream and aren't retried:
+	// the guest would be dumped again.
+	backupAttempts   = 2
+	backupRetryDelay = 30 * time.Second
+)
+
+type prunableMachine struct {
+	Bjd BackupJobData
+	// BackedUp is false when no backup ran, and Backups is meaningless
+	BackedUp bool
+	Backups  RepositoryResults
+}
+
+func machineTypeName(machineType ProxmoxCLI.MachineType) string {
+	switch machineType {
+	case ProxmoxCLI.VM:
+		return "VM"
+	case ProxmoxCLI.LXC:
+		return "LXC"
+	case "":
+		return "VM/LXC"
+	default:
+		return string(machineType)
+	}
+}
+
+// resolveMachines reads all of the job's VM pools, and deduplicates their VMs/LXCs by VMID.
+func (s *JobData) resolveMachines(jobName string, js BackupJobSettings, skippedMachines map[uint64]struct{}) (map[uint64]BackupJobData, error) {
+	machines := make(map[uint64]BackupJobData, 64)
+
+	naming, err := newArchiveNaming(jobName, js)
+	if err != nil {
+		return nil, fmt.Errorf("backup job %v: %w", jobName, err)
+	}
+
+	// Look through all requested VM pools
+	for _, vmPool := range js.VmPool {
+		newMachines, err := ProxmoxCLI.GetMachinesByPool(vmPool)
+		if err != nil {
+			return nil, fmt.Errorf("cannot receive Proxmox machines with pool %v in Backup Job %v: %w", vmPool, jobName, err)
+		}
+
+		// Array of VMs to associative map of VMs.
+		// Avoid duplicate backups of VMs that appear in two different pools.
+
+		for _, machine := range newMachines {
+			switch machine.Type {
+			case ProxmoxCLI.LXC:
+				machines[machine.VMID] = BackupJobData{
+					Info:   machine,
+					naming: naming,
+				}
+			case ProxmoxCLI.VM:
+				machines[machine.VMID] = BackupJobData{
+					Info:   machine,
+					naming: naming,
+				}
+			default:
+				if _, ok := skippedMachines[machine.VMID]; !ok {
+					skippedMachines[machine.VMID] = struct{}{}
+					jobLogger(jobName, "").Warn("Invalid machine type, skipping", "vmid", machine.VMID, "type", string(machine.Type))
+				}
+			}
+		}
+	}
+
+	// Pool members don't always carry their tags
+	if js.hasTagOverrides() && len(machines) > 0 {
+		clusterMachines, err := ProxmoxCLI.GetClusterMachines()
+		if err != nil {
+			return nil, fmt.Errorf("cannot receive the tags of Proxmox machines in Backup Job %v: %w", jobName, err)
+		}
+		for _, clusterMachine := range clusterMachines {
+			if machine, ok := machines[clusterMachine.VMID]; ok && machine.Info.Tags == "" {
+				machine.Info.Tags = clusterMachine.Tags
+				machines[clusterMachine.VMID] = machine
+			}
+		}
+	}
+
+	return machines, nil
+}
+
 func (s *JobData) RunJob(options JobOptions) map[string]JobResult {
+	if options.DryRun {
+		return s.dryRun(options, os.Stdout)
+	}
+
 	jobResults := make(map[string]JobResult, len(s.BackupJobs))
 
+	// Keep the end of the log for the heartbeats
+	s.runID = newRunID()
+	s.logTail = &logTail{size: heartbeatLogTail}
+	defer logOutput.capture(s.logTail)()
+
+	s.runStarted = time.Now()
+	s.compactResults = nil
+	s.guestLogRunDirectory = s.guestLogRun(s.runStarted)
+	slog.Info("Starting run", "run_id", s.runID)
+	runHeartbeat := s.heartbeat("", s.Heartbeat)
+	runHeartbeat.ping(HE_Start)
+
+	// Notifications that couldn't be delivered by the previous runs go first
+	s.failedNotifiers = map[string]error{}
+	spoolFailures := s.flushSpool()
+	s.failedNotifications = spoolFailures[""]
+
 	skippedMachines := make(map[uint64]struct{}, 64)
-	var err error
+	checkedRepositories := make(map[string]error, len(s.BackupJobs))
+	var state *persistentState
 
-	// Look through all Backup Jobs
-nextJob:
+	// Read the pools of all jobs first, orphaned archives can only be found knowing every VM/LXC that's being backed up
+	jobMachines := make(map[string]map[uint64]BackupJobData, len(s.BackupJobs))
 	for jobName, jobSettings := range s.BackupJobs {
-		machines := make(map[uint64]BackupJobData, 64)
-		var newMachines []ProxmoxCLI.MachineInfo
-
-		// Look through all requested VM pools
-		for _, vmPool := range jobSettings.VmPool {
-			if newMachines, err = ProxmoxCLI.GetMachinesByPool(vmPool); err != nil {
-				jobResults[jobName] = JobResult{
-					Error: fmt.Errorf("cannot receive Proxmox machines with pool %v in Backup Job %v: %w", vmPool, jobName, err),
-				}
-				continue nextJob
-			}
-
-			// Array of VMs to associative map of VMs.
-			// Avoid duplicate backups of VMs that appear in two different pools.
+		machines, err := s.resolveMachines(jobName, jobSettings, skippedMachines)
+		if err != nil {
+			jobLogger(jobName, "").Error("Backup Job failed", "error", err)
+			jobHeartbeat := s.heartbeat(jobName, jobSettings.Heartbeat)
+			jobHeartbeat.ping(HE_Start)
+			jobHeartbeat.ping(HE_Fail)
 
-			for _, machine := range newMachines {
-				switch machine.Type {
-				case ProxmoxCLI.LXC:
-					machines[machine.VMID] = BackupJobData{
-						Info: machine,
-					}
-				case ProxmoxCLI.VM:
-					machines[machine.VMID] = BackupJobData{
-						Info: machine,
-					}
-				default:
-					if _, ok := skippedMachines[machine.VMID]; !ok {
-						skippedMachines[machine.VMID] = struct{}{}
-						log.Printf("Invalid machine type '%v' for VMID %v, skipping.", string(machine.Type), machine.VMID)
-					}
-				}
+			jobResults[jobName] = JobResult{
+				Error:               err,
+				FailedNotifications: spoolFailures[jobName],
 			}
+			continue
 		}
+		jobMachines[jobName] = machines
+	}
+	active := s.newActiveArchives(jobMachines)
+
+	// Look through all Backup Jobs
+	for jobName, jobSettings := range s.BackupJobs {
+		machines, ok := jobMachines[jobName]
+		if !ok {
+			continue
+		}
+		var err error
+
+		s.heartbeat(jobName, jobSettings.Heartbeat).ping(HE_Start)
 
 		result := JobResult{
-			SucceededBackups: make(map[uint64]struct{}, len(machines)),
-			FailedBackups:    make(map[uint64]error, len(machines)),
-			SucceededPrunes:  make(map[uint64]struct{}, len(machines)),
-			FailedPrunes:     make(map[uint64]error, len(machines)),
+			Machines:             make(map[uint64]ProxmoxCLI.MachineInfo, len(machines)),
+			SucceededBackups:     make(map[uint64]struct{}, len(machines)),
+			FailedBackups:        make(map[uint64]error, len(machines)),
+			FailedReplicaBackups: make(map[uint64]error, len(machines)),
+			RepositoryBackups:    make(map[uint64]RepositoryResults, len(machines)),
+			BackupStats:          make(map[uint64]StreamStats, len(machines)),
+			BackupLogs:           make(map[uint64]string),
+			SucceededPrunes:      make(map[uint64]struct{}, len(machines)),
+			FailedPrunes:         make(map[uint64]error, len(machines)),
+			PrunedArchives:       make(map[uint64]PrunedArchives, len(machines)),
+			BackupAttempts:       make(map[uint64]int, len(machines)),
+			BackupDurations:      make(map[uint64]time.Duration, len(machines)),
+			BackupWarnings:       make(map[uint64]error),
+			PruneWarnings:        make(map[uint64]error),
+			FailedNotifications:  spoolFailures[jobName],
+		}
+
+		if !options.DontPrune {
+			if err := jobSettings.staleOverrides(jobName, machines); err != nil {
+				jobLogger(jobName, NPH_Prune).Warn("Stale prune override", "error", err)
+				result.StaleOverrides = err
+			}
 		}
 
 		// Run the backups of all requested VMs, sorting by VMID.
 		keys := sortedMapKeys(machines)
+		for _, key := range keys {
+			result.Machines[key] = machines[key].Info
+		}
 
-		prunableMachines := []struct {
-			Bjd BackupJobData
-			Js  BackupJobSettings
-		}{}
+		prunableMachines := []prunableMachine{}
 
 		for _, key := range keys {
 			machine := machines[key]
 
-			if !options.DontBackup {
-				switch machine.Info.Type {
-				case ProxmoxCLI.VM:
-					if err := s.runVmBackup(jobName, machine, jobSettings); err != nil {
-						result.FailedBackups[machine.Info.VMID] = err
-						if jobSettings.Notification.BackupTargetInfo.Frequency == NF_EveryVmFinished {
-							s.sendFailureNotification(jobSettings, jobSettings.Notification.BackupTargetInfo, "VM backup failed!", fmt.Sprintf("VM VMID %v: Backup failed!\n%v", machine.Info.VMID, err.Error()), []string{})
-						}
-					} else {
-						result.SucceededBackups[machine.Info.VMID] = struct{}{}
-						prunableMachines = append(prunableMachines, struct {
-							Bjd BackupJobData
-							Js  BackupJobSettings
-						}{
-							Bjd: machine,
-							Js:  jobSettings,
-						})
-
-						if jobSettings.Notification.BackupTargetInfo.Frequency == NF_EveryVmFinished {
-							s.sendSuccessNotification(jobSettings, jobSettings.Notification.BackupTargetInfo, "VM backup completed!", fmt.Sprintf("VM VMID %v: Backup completed!", machine.Info.VMID), []string{})
-						}
-					}
-				case ProxmoxCLI.LXC:
-					if err := s.runLxcBackup(jobName, machine, jobSettings); err != nil {
-						result.FailedBackups[machine.Info.VMID] = err
-						if jobSettings.Notification.BackupTargetInfo.Frequency == NF_EveryVmFinished {
-							s.sendFailureNotification(jobSettings, jobSettings.Notification.BackupTargetInfo, "LXC backup failed!", fmt.Sprintf("LXC VMID %v: Backup failed!\n%v", machine.Info.VMID, err.Error()), []string{})
-						}
-					} else {
-						result.SucceededBackups[machine.Info.VMID] = struct{}{}
-						prunableMachines = append(prunableMachines, struct {
-							Bjd BackupJobData
-							Js  BackupJobSettings
-						}{
-							Bjd: machine,
-							Js:  jobSettings,
-						})
-
-						if jobSettings.Notification.BackupTargetInfo.Frequency == NF_EveryVmFinished {
-							s.sendSuccessNotification(jobSettings, jobSettings.Notification.BackupTargetInfo, "LXC backup completed!", fmt.Sprintf("LXC VMID %v: Backup completed!", machine.Info.VMID), []string{})
-						}
-					}
-				}
-			} else {
-				prunableMachines = append(prunableMachines, struct {
-					Bjd BackupJobData
-					Js  BackupJobSettings
-				}{
+			if options.DontBackup {
+				prunableMachines = append(prunableMachines, prunableMachine{
 					Bjd: machine,
-					Js:  jobSettings,
 				})
+				continue
+			}
+
+			var repositoryResults RepositoryResults
+			var stats StreamStats
+			output := newGuestOutput()
+			logger, guestLog := s.openGuestLog(guestLogger(jobName, NPH_Backup, machine.Info), jobName, machine.Info)
+			started := time.Now()
+			repositoryResults, stats, result.BackupAttempts[machine.Info.VMID], err = s.runGuestBackup(logger, jobName, machine, jobSettings, output)
+			result.BackupDurations[machine.Info.VMID] = time.Since(started)
+			if warning := repositoryResults.takeWarnings(); warning != nil {
+				logger.Warn("Backed up with warnings", "warning", warning)
+				result.BackupWarnings[machine.Info.VMID] = warning
+			}
+			if isBorgWarning(err) {
+				err = nil
+			}
+			result.RepositoryBackups[machine.Info.VMID] = repositoryResults
+			result.BackupStats[machine.Info.VMID] = stats
+
+			event := NotificationEvent{
+				Job:         jobName,
+				Phase:       NPH_Backup,
+				Outcome:     NO_Success,
+				Machines:    result.Machines,
+				Frequency:   NF_EveryVmFinished,
+				VMID:        machine.Info.VMID,
+				MachineType: machine.Info.Type,
+				Stats:       &stats,
+			}
+			if err != nil {
+				logger.Error("Backup failed", "error", err)
+				result.FailedBackups[machine.Info.VMID] = err
+				result.BackupLogs[machine.Info.VMID] = output.String()
+				event.Outcome = NO_Failure
+				event.Error = err
+				event.Log = result.BackupLogs[machine.Info.VMID]
+			} else {
+				result.SucceededBackups[machine.Info.VMID] = struct{}{}
+
+				if replicaErr := repositoryResults.replicaError(jobSettings.Borg.Repository); replicaErr != nil {
+					result.FailedReplicaBackups[machine.Info.VMID] = replicaErr
+					result.BackupLogs[machine.Info.VMID] = output.String()
+					event.Outcome = NO_Partial
+					event.Error = replicaErr
+					event.Log = result.BackupLogs[machine.Info.VMID]
+				}
 			}
+			if guestLog != nil {
+				guestLog.Close()
+			}
+			s.notify(jobSettings, event, &result)
+
+			// Repositories that didn't receive a new archive are refused by the prune guards
+			prunableMachines = append(prunableMachines, prunableMachine{
+				Bjd:      machine,
+				BackedUp: true,
+				Backups:  repositoryResults,
+			})
 		}
 
-		if jobSettings.Borg.Prune.Enabled {
-			if !options.DontPrune {
+		if !options.DontPrune {
+			if jobSettings.hasPrune() {
 				for _, pruneData := range prunableMachines {
-					if err := s.runPrune(pruneData.Bjd, pruneData.Js); err != nil {
+					event := NotificationEvent{
+						Job:         jobName,
+						Phase:       NPH_Prune,
+						Outcome:     NO_Success,
+						Machines:    result.Machines,
+						Frequency:   NF_EveryVmFinished,
+						VMID:        pruneData.Bjd.Info.VMID,
+						MachineType: pruneData.Bjd.Info.Type,
+					}
+					logger := guestLogger(jobName, NPH_Prune, pruneData.Bjd.Info)
+					pruned, err := s.runPrunes(logger, pruneData, jobSettings)
+					if len(pruned) > 0 {
+						result.PrunedArchives[pruneData.Bjd.Info.VMID] = pruned
+					}
+					if isBorgWarning(err) {
+						logger.Warn("Pruned with warnings", "warning", err)
+						result.SucceededPrunes[pruneData.Bjd.Info.VMID] = struct{}{}
+						result.PruneWarnings[pruneData.Bjd.Info.VMID] = err
+					} else if err != nil {
+						logger.Error("Prune failed", "error", err)
 						result.FailedPrunes[pruneData.Bjd.Info.VMID] = err
-						if jobSettings.Notification.PruneTargetInfo.Frequency == NF_EveryVmFinished {
-							s.sendFailureNotification(pruneData.Js, jobSettings.Notification.PruneTargetInfo, "Archive prune failed!", fmt.Sprintf("VMID %v Archive: Prune failed!\n%v", pruneData.Bjd.Info.VMID, err.Error()), []string{})
-						}
+						event.Outcome = NO_Failure
+						event.Error = err
 					} else {
 						result.SucceededPrunes[pruneData.Bjd.Info.VMID] = struct{}{}
-						if jobSettings.Notification.PruneTargetInfo.Frequency == NF_EveryVmFinished {
-							s.sendSuccessNotification(pruneData.Js, jobSettings.Notification.PruneTargetInfo, "Archive prune completed!", fmt.Sprintf("VMID %v Archive: Prune completed!", pruneData.Bjd.Info.VMID), []string{})
-						}
 					}
+					s.notify(jobSettings, event, &result)
 				}
 
-				if jobSettings.Borg.Prune.Compact {
-					if err := s.runCompact(jobSettings); err != nil {
-						result.FailedCompact = err
-						if jobSettings.Notification.PruneTargetInfo.Frequency == NF_EveryVmFinished {
-							s.sendFailureNotification(jobSettings, jobSettings.Notification.PruneTargetInfo, "Repository compact failed!", fmt.Sprintf("Repository: Compact failed!\n%v", err.Error()), []string{})
-						}
-					} else {
-						if jobSettings.Notification.PruneTargetInfo.Frequency == NF_EveryVmFinished {
-							s.sendSuccessNotification(jobSettings, jobSettings.Notification.PruneTargetInfo, "Repository compact succeeded!", "Repository: Compact succeeded!", []string{})
-						}
-					}
+				if guarded := pruneGuardErrors(result.FailedPrunes); len(guarded) > 0 {
+					s.notify(jobSettings, NotificationEvent{
+						Job:      jobName,
+						Phase:    NPH_PruneGuard,
+						Outcome:  NO_Failure,
+						Machines: result.Machines,
+						Failed:   guarded,
+					}, &result)
 				}
 			}
 		}
 
 		jobResults[jobName] = result
+	}
 
-		if jobSettings.Notification.BackupTargetInfo.Frequency == NF_EntireJobFinished {
-			if len(result.FailedBackups) > 0 && len(result.SucceededBackups) > 0 {
-				strMessage := "Succeeded:\n"
-				for vmid := range result.SucceededBackups {
-					strMessage += "- " + strconv.FormatUint(vmid, 10) + "\n"
-				}
-				strMessage += "\nFailed:\n"
-				for vmid, err := range result.FailedBackups {
-					strMessage += "- " + strconv.FormatUint(vmid, 10) + " (" + err.Error() + ")\n"
+	// Orphans are handled once per repository, before compacting so that their space is freed right away
+	if !options.DontPrune {
+		resolvedJobs := []string{}
+		for _, jobName := range sortedJobNames(s.BackupJobs) {
+			if _, ok := jobMachines[jobName]; ok {
+				resolvedJobs = append(resolvedJobs, jobName)
+			}
+		}
+		for jobName, orphans := range s.runSharedOrphans(resolvedJobs, active) {
+			result := jobResults[jobName]
+			result.Orphans = orphans
+			for _, orphan := range orphans {
+				event := NotificationEvent{
+					Job:         jobName,
+					Phase:       NPH_Orphans,
+					Outcome:     NO_Success,
+					Frequency:   NF_EveryVmFinished,
+					VMID:        orphan.VMID,
+					MachineType: orphan.Type,
+					Repository:  orphan.Repository,
+					Orphans:     []OrphanResult{orphan},
 				}
-				target := jobSettings.Notification.BackupTargetInfo
-				target.FailurePriority = highestPriority(target.FailurePriority, target.SuccessPriority)
-				s.sendFailureNotification(jobSettings, target, "Backup Job incomplete!", "Some VM/LXC backup jobs failed!\n"+strMessage, []string{})
-			} else if len(result.FailedBackups) > 0 {
-				strMessage := "\n"
-				for vmid, err := range result.FailedBackups {
-					strMessage += "- " + strconv.FormatUint(vmid, 10) + " (" + err.Error() + ")\n"
+				if orphan.Error != nil {
+					event.Outcome = NO_Failure
+					event.Error = orphan.Error
 				}
-				s.sendFailureNotification(jobSettings, jobSettings.Notification.BackupTargetInfo, "Backup Job failed!", "All VM/LXC backup jobs failed!\n"+strMessage, []string{})
-			} else if len(result.SucceededBackups) > 0 {
-				s.sendSuccessNotification(jobSettings, jobSettings.Notification.BackupTargetInfo, "Backup Job completed!", "All VM/LXC backup jobs succeeded!", []string{})
+				s.notify(s.BackupJobs[jobName], event, &result)
 			}
+			jobResults[jobName] = result
 		}
+	}
 
-		if jobSettings.Notification.PruneTargetInfo.Frequency == NF_EntireJobFinished {
-			if len(result.FailedPrunes) > 0 || result.FailedCompact != nil {
-				strMessage := ""
-				strTitle := ""
+	// Compact each repository once, after every job that prunes it is done
+	if !options.DontPrune {
+		prunedJobs := []string{}
+		for _, jobName := range sortedJobNames(s.BackupJobs) {
+			if _, ok := jobMachines[jobName]; ok && s.BackupJobs[jobName].hasCompact() {
+				prunedJobs = append(prunedJobs, jobName)
+			}
+		}
+		if len(prunedJobs) > 0 {
+			var err error
+			if state == nil {
+				if state, err = s.loadState(); err != nil {
+					jobLogger("", NPH_Compact).Warn("Cannot load the previous state, all repository compactions are due", "error", err)
+				}
+			}
+			s.compactResults = s.runSharedCompacts(prunedJobs, state, time.Now())
+			for _, jobName := range prunedJobs {
+				result := jobResults[jobName]
+				result.CompactRan = s.BackupJobs[jobName].compacted(s.compactResults)
+				if err := s.BackupJobs[jobName].compactError(s.compactResults); isBorgWarning(err) {
+					result.CompactWarning = err
+				} else {
+					result.FailedCompact = err
+				}
+				jobResults[jobName] = result
+			}
+		}
+	}
 
-				if len(result.SucceededPrunes) > 0 || result.FailedCompact == nil {
-					strTitle = "Prune Job incomplete!"
-					strMessage = "Some VM/LXC prune jobs failed!\n"
+	// Finish every job with its checks and notifications
+	for _, jobName := range sortedJobNames(s.BackupJobs) {
+		jobSettings := s.BackupJobs[jobName]
+		if _, ok := jobMachines[jobName]; !ok {
+			continue
+		}
+		result := jobResults[jobName]
+		var err error
 
-					strMessage := "Succeeded:\n"
-					for vmid := range result.SucceededPrunes {
-						strMessage += "- " + strconv.FormatUint(vmid, 10) + "\n"
-					}
-					if result.FailedCompact == nil {
-						strMessage += "- Compact job\n"
-					}
+		if result.CompactRan {
+			event := NotificationEvent{
+				Job:       jobName,
+				Phase:     NPH_Compact,
+				Outcome:   NO_Success,
+				Frequency: NF_EveryVmFinished,
+				Error:     result.FailedCompact,
+			}
+			if result.FailedCompact != nil {
+				event.Outcome = NO_Failure
+			}
+			s.notify(jobSettings, event, &result)
+		}
 
-					strMessage += "\n"
-				} else {
-					strTitle = "Prune Job failed!"
-					strMessage = "All VM/LXC prune jobs failed!\n"
+		if jobSettings.hasCheck(true) && !options.DontCheck {
+			if state == nil {
+				if state, err = s.loadState(); err != nil {
+					jobLogger(jobName, NPH_Check).Warn("Cannot load the previous state, all repository checks are due", "error", err)
 				}
+			}
+			s.checkJob(jobName, jobSettings, state, false, true, checkedRepositories, &result)
+		}
 
-				strMessage += "Failed:\n"
-				for vmid, err := range result.FailedPrunes {
-					strMessage += "- " + strconv.FormatUint(vmid, 10) + " (" + err.Error() + ")\n"
-				}
-				if result.FailedCompact != nil {
-					strMessage += "- Compact job (" + err.Error() + ")\n"
-				}
+		if event, ok := result.backupSummary(jobName); ok {
+			s.notify(jobSettings, event, &result)
+		}
+		if event, ok := result.pruneSummary(jobName); ok {
+			s.notify(jobSettings, event, &result)
+		}
 
-				target := jobSettings.Notification.PruneTargetInfo
-				target.FailurePriority = highestPriority(target.FailurePriority, target.SuccessPriority)
-				s.sendFailureNotification(jobSettings, target, strTitle, strMessage, []string{})
-			} else if len(result.SucceededPrunes) > 0 {
-				s.sendSuccessNotification(jobSettings, jobSettings.Notification.PruneTargetInfo, "Prune Job completed!", "All VM/LXC prune and compact jobs succeeded!", []string{})
-			}
+		jobResults[jobName] = result
+		s.heartbeat(jobName, jobSettings.Heartbeat).finish(result.IsFailed())
+	}
+
+	if state != nil {
+		if err := state.save(); err != nil {
+			slog.Error("Cannot save the current state", "error", err)
 		}
+	}
 
+	s.pruneGuestLogs()
+
+	failed := false
+	for _, result := range jobResults {
+		failed = failed || result.IsFailed()
 	}
+	runHeartbeat.finish(failed)
 
 	return jobResults
 }
+
+// runGuestBackup backs up a VM/LXC, and tries again when no repository could be locked.
+// It also returns how many attempts it took.
+func (s *JobData) runGuestBackup(logger *slog.Logger, jobName string, machine BackupJobData, js BackupJobSettings, output io.Writer) (RepositoryResults, StreamStats, int, error) {
+	for attempt := 1; ; attempt++ {
+		var results RepositoryResults
+		var stats StreamStats
+		var err error
+		switch machine.Info.Type {
+		case ProxmoxCLI.VM:
+			results, stats, err = s.runVmBackup(logger, jobName, machine, js, output)
+		case ProxmoxCLI.LXC:
+			results, stats, err = s.runLxcBackup(logger, jobName, machine, js, output)
+		}
+		if attempt >= backupAttempts || !results.locked() {
+			return results, stats, attempt, err
+		}
+
+		logger.Warn("Backup failed, trying again", "attempt", attempt, "delay", backupRetryDelay, "error", err)
+		time.Sleep(backupRetryDelay)
+	}
+}
+
+// backupSummary returns the event that sums up the backups of a job, if any backup ran.
+func (r JobResult) backupSummary(jobName string) (NotificationEvent, bool) {
+	event := NotificationEvent{
+		Job:            jobName,
+		Phase:          NPH_Backup,
+		Outcome:        NO_Success,
+		Frequency:      NF_EntireJobFinished,
+		Succeeded:      sortedVMIDs(r.SucceededBackups),
+		Failed:         r.FailedBackups,
+		FailedReplicas: r.FailedReplicaBackups,
+		BackupStats:    r.BackupStats,
+		Machines:       r.Machines,
+		Log:            r.backupLog(),
+	}
+
+	if len(r.FailedBackups) > 0 && len(r.SucceededBackups) > 0 {
+		event.Outcome = NO_Partial
+	} else if len(r.FailedBackups) > 0 {
+		event.Outcome = NO_Failure
+	} else if len(r.FailedReplicaBackups) > 0 {
+		event.Outcome = NO_Partial
+	} else if len(r.SucceededBackups) == 0 {
+		return event, false
+	}
+	return event, true
+}
+
+// backupLog joins the captured output of the VMs/LXCs whose backup failed, even partially.
+func (r JobResult) backupLog() string {
+	vmids := make([]uint64, 0, len(r.BackupLogs))
+	for vmid := range r.BackupLogs {
+		vmids = append(vmids, vmid)
+	}
+	sort.Slice(vmids, func(i, j int) bool {
+		return vmids[i] < vmids[j]
+	})
+
+	logs := []string{}
+	for _, vmid := range vmids {
+		if r.BackupLogs[vmid] == "" {
+			continue
+		}
+		machine := r.Machines[vmid]
+		logs = append(logs, fmt.Sprintf("==> %v %v (%v) <==\n%v", machineTypeName(machine.Type), vmid, machine.Name, r.BackupLogs[vmid]))
+	}
+	return strings.Join(logs, "\n\n")
+}
+
+// pruneSummary returns the event that sums up the prunes, orphans and compactions of a job, if any of them ran.
+func (r JobResult) pruneSummary(jobName string) (NotificationEvent, bool) {
+	event := NotificationEvent{
+		Job:       jobName,
+		Phase:     NPH_Prune,
+		Outcome:   NO_Success,
+		Frequency: NF_EntireJobFinished,
+		Succeeded: sortedVMIDs(r.SucceededPrunes),
+		Machines:  r.Machines,
+		Failed:    r.FailedPrunes,
+		Orphans:   r.Orphans,
+		Compact:   r.CompactRan,
+		Error:     r.FailedCompact,
+
+		StaleOverrides: r.StaleOverrides,
+	}
+
+	if len(r.FailedPrunes) > 0 || r.FailedCompact != nil || len(orphanErrors(r.Orphans)) > 0 {
+		if len(r.SucceededPrunes) > 0 || (r.CompactRan && r.FailedCompact == nil) {
+			event.Outcome = NO_Partial
+		} else {
+			event.Outcome = NO_Failure
+		}
+	} else if len(r.SucceededPrunes) == 0 && len(r.Orphans) == 0 {
+		return event, false
+	}
+	return event, true
+}
@@ -1,17 +1,14 @@
 package Job
 
 import (
-	"borgmox/BorgCLI"
 	"borgmox/ProxmoxCLI"
 	"fmt"
-	"log"
-	"os"
-	"os/exec"
+	"io"
+	"log/slog"
 	"strconv"
-	"time"
 )
 
-func (s *JobData) runLxcBackup(jobName string, bjd BackupJobData, js BackupJobSettings) error {
+func lxcBackupSettings(jobName string, bjd BackupJobData, js BackupJobSettings) (ProxmoxCLI.StartImageBackupSettings, string, error) {
 	switch js.LxcMode {
 	case LXCBKP_Image:
 		BackupSettings := ProxmoxCLI.StartImageBackupSettings{
@@ -22,38 +19,19 @@ func (s *JobData) runLxcBackup(jobName string, bjd BackupJobData, js BackupJobSe
 				"borgmox-lxc-vmid_" + strconv.FormatUint(bjd.Info.VMID, 10) + "-id_" + removeSpaces(bjd.Info.ID) + "-job_" + removeSpaces(jobName),
 			},
 		}
-		ArchiveSettings := BorgCLI.CreateArchiveSettings{
-			Compression: "auto,zlib",
-			AdditionalArgs: []string{
-				"--progress",
-			},
-		}
-
-		var cmdBackup *exec.Cmd
-		var err error
-		if cmdBackup, err = ProxmoxCLI.StartImageBackup(bjd.Info.VMID, BackupSettings); err != nil {
-			return err
-		}
-
-		archivePrefix := genArchivePrefix(js.ArchivePrefix, bjd.Info)
-		archiveName := genArchiveName(archivePrefix, time.Now(), "tar")
-
-		var cmdRunAll *exec.Cmd
-		if cmdRunAll, err = BorgCLI.CreateArchiveExec(js.Borg, archiveName, ArchiveSettings, cmdBackup); err != nil {
-			return err
-		}
-
-		cmdRunAll.Stdout = os.Stdout
-		cmdRunAll.Stderr = os.Stderr
-
-		log.Printf("Now backing up LXC %v (%v)", bjd.Info.Name, bjd.Info.VMID)
-		if err := cmdRunAll.Run(); err != nil {
-			return err
-		}
-
-		return nil
+		return BackupSettings, "tar", nil
 
 	default:
-		return fmt.Errorf("unimplemented backup method for LXCs: %v", string(js.LxcMode))
+		return ProxmoxCLI.StartImageBackupSettings{}, "", fmt.Errorf("unimplemented backup method for LXCs: %v", string(js.LxcMode))
 	}
 }
+
+func (s *JobData) runLxcBackup(logger *slog.Logger, jobName string, bjd BackupJobData, js BackupJobSettings, output io.Writer) (RepositoryResults, StreamStats, error) {
+	BackupSettings, archiveExtension, err := lxcBackupSettings(jobName, bjd, js)
+	if err != nil {
+		return nil, StreamStats{}, err
+	}
+
+	logger.Info("Now backing up LXC")
+	return s.runImageBackup(logger, bjd, js, BackupSettings, archiveExtension, output)
+}
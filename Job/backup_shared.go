@@ -2,15 +2,18 @@ package Job
 
 import (
 	"borgmox/ProxmoxCLI"
+	"errors"
 	"fmt"
 	"os"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 )
 
 var cachedHostname string
 var removeSpacesRegex *regexp.Regexp
+var archiveFieldRegex *regexp.Regexp
 
 func removeSpaces(input string) string {
 	if removeSpacesRegex == nil {
@@ -20,9 +23,18 @@ func removeSpaces(input string) string {
 	return removeSpacesRegex.ReplaceAllString(input, "_")
 }
 
-func genArchivePrefix(hostname string, machineInfo ProxmoxCLI.MachineInfo) string {
-	var prefix string
+// archiveField makes a value safe to be used in an archive name, and in the glob that matches it.
+func archiveField(input string) string {
+	if archiveFieldRegex == nil {
+		archiveFieldRegex = regexp.MustCompile(`[\s*?\[\]\\/:]`)
+	}
+
+	return archiveFieldRegex.ReplaceAllString(input, "_")
+}
 
+// archiveHostname returns the hostname used in the archive names.
+// It's used as is, like before the archive name templates, so that the existing archives still match.
+func archiveHostname(hostname string) string {
 	// Hostname empty => System Hostname
 	if hostname == "" {
 		if cachedHostname == "" {
@@ -30,21 +42,297 @@ func genArchivePrefix(hostname string, machineInfo ProxmoxCLI.MachineInfo) strin
 		}
 		hostname = cachedHostname
 	}
+	return hostname
+}
+
+const DefaultArchiveNameTemplate = "{hostname}-{type}-{vmid}-{timestamp}"
+
+const archiveTimestampLayout = "2006_01_02-15_04_05"
+const archiveTimestampPattern = `\d{4}_\d{2}_\d{2}-\d{2}_\d{2}_\d{2}`
+
+const (
+	AT_Hostname  = "hostname"
+	AT_Node      = "node"
+	AT_Type      = "type"
+	AT_VMID      = "vmid"
+	AT_Name      = "name"
+	AT_Job       = "job"
+	AT_Timestamp = "timestamp"
+)
+
+// templatePart is either a literal, or a placeholder when placeholder isn't empty.
+type templatePart struct {
+	literal     string
+	placeholder string
+}
+
+// archiveNaming generates and parses the archive names of a job.
+// The archive names of a VM/LXC share a prefix, which is everything before {timestamp}.
+type archiveNaming struct {
+	parts    []templatePart
+	hostname string
+	jobName  string
+	location *time.Location
+	// Matches the archive names of the template, see parse
+	pattern *regexp.Regexp
+}
+
+func newArchiveNaming(jobName string, js BackupJobSettings) (archiveNaming, error) {
+	naming := archiveNaming{
+		hostname: archiveHostname(js.ArchivePrefix),
+		jobName:  archiveField(jobName),
+		location: time.UTC,
+	}
+
+	// The archives are listed and pruned with a glob, which the prefix must not change
+	if strings.ContainsAny(naming.hostname, "*?[]\\/") {
+		return naming, fmt.Errorf("archive prefix %q can't contain any of * ? [ ] \\ /", naming.hostname)
+	}
+
+	if js.ArchiveTimezone != "" {
+		location, err := time.LoadLocation(js.ArchiveTimezone)
+		if err != nil {
+			return naming, fmt.Errorf("invalid archive timezone %v: %w", js.ArchiveTimezone, err)
+		}
+		naming.location = location
+	}
 
-	if hostname != "" {
-		prefix = hostname + "-"
+	template := js.ArchiveNameTemplate
+	if template == "" {
+		template = DefaultArchiveNameTemplate
 	}
 
-	return prefix + string(machineInfo.Type) + "-" + strconv.FormatUint(machineInfo.VMID, 10) + "-"
+	parts, err := parseArchiveNameTemplate(template)
+	if err != nil {
+		return naming, fmt.Errorf("invalid archive name template %v: %w", template, err)
+	}
+	if naming.hostname == "" {
+		parts = withoutHostname(parts)
+	}
+	naming.parts = parts
+	naming.pattern = naming.compile()
+	return naming, nil
+}
+
+// withoutHostname drops {hostname} along with the separator that follows it,
+// like the archive names before the templates did when there was no hostname.
+func withoutHostname(parts []templatePart) []templatePart {
+	result := []templatePart{}
+	for i := 0; i < len(parts); i++ {
+		if parts[i].placeholder != AT_Hostname {
+			result = append(result, parts[i])
+			continue
+		}
+		if i+1 < len(parts) && parts[i+1].placeholder == "" {
+			i++
+			if literal := parts[i].literal[1:]; literal != "" {
+				result = append(result, templatePart{literal: literal})
+			}
+		}
+	}
+	return result
 }
 
-func genArchiveName(prefix string, ts time.Time, archiveExtension string) string {
-	archiveName := prefix
+func parseArchiveNameTemplate(template string) ([]templatePart, error) {
+	parts := []templatePart{}
+	seen := map[string]struct{}{}
 
-	ts = ts.UTC()
-	archiveName += fmt.Sprintf("%d_%02d_%02d-%02d_%02d_%02d", ts.Year(), ts.Month(), ts.Day(), ts.Hour(), ts.Minute(), ts.Second())
+	for rest := template; rest != ""; {
+		start := strings.IndexAny(rest, "{}")
+		if start < 0 {
+			start = len(rest)
+		} else if rest[start] == '}' {
+			return nil, errors.New("unmatched '}'")
+		}
+		if start > 0 {
+			// The archives are listed and pruned with a glob, which the literals must not change
+			if strings.ContainsAny(rest[:start], "*?[]\\/") {
+				return nil, fmt.Errorf("%q can't contain any of * ? [ ] \\ /", rest[:start])
+			}
+			parts = append(parts, templatePart{literal: rest[:start]})
+		}
+		if start == len(rest) {
+			break
+		}
+
+		end := strings.IndexByte(rest[start:], '}')
+		if end < 0 {
+			return nil, errors.New("unmatched '{'")
+		}
+		placeholder := rest[start+1 : start+end]
+		switch placeholder {
+		case AT_Hostname, AT_Node, AT_Type, AT_VMID, AT_Name, AT_Job, AT_Timestamp:
+		default:
+			return nil, fmt.Errorf("unknown placeholder {%v}", placeholder)
+		}
+		if _, ok := seen[placeholder]; ok {
+			return nil, fmt.Errorf("placeholder {%v} is used more than once", placeholder)
+		}
+		seen[placeholder] = struct{}{}
+		if len(parts) > 0 && parts[len(parts)-1].placeholder != "" {
+			return nil, fmt.Errorf("placeholder {%v} must be separated from the previous one, or the name can't be parsed back", placeholder)
+		}
+
+		parts = append(parts, templatePart{placeholder: placeholder})
+		rest = rest[start+end+1:]
+	}
+
+	// The VMID keeps the archives of two VMs/LXCs apart: only fixed values can come before it,
+	// and it must be followed by something that isn't a digit
+	vmidIndex := -1
+	for i, part := range parts {
+		switch part.placeholder {
+		case AT_VMID:
+			vmidIndex = i
+		case AT_Node, AT_Name, AT_Job:
+			if vmidIndex < 0 {
+				return nil, fmt.Errorf("placeholder {%v} must come after {%v}, or the archives of two VMs/LXCs could collide", part.placeholder, AT_VMID)
+			}
+		}
+	}
+	if vmidIndex < 0 {
+		return nil, fmt.Errorf("placeholder {%v} is required", AT_VMID)
+	}
+	// Hosts often share a repository
+	if _, ok := seen[AT_Hostname]; !ok {
+		return nil, fmt.Errorf("placeholder {%v} is required, or the archives of two hosts could collide", AT_Hostname)
+	}
+	if _, ok := seen[AT_Timestamp]; !ok {
+		return nil, fmt.Errorf("placeholder {%v} is required", AT_Timestamp)
+	}
+	if parts[len(parts)-1].placeholder != AT_Timestamp {
+		return nil, fmt.Errorf("the template must end with {%v}", AT_Timestamp)
+	}
+	if next := parts[vmidIndex+1]; next.placeholder != "" || next.literal[0] >= '0' && next.literal[0] <= '9' {
+		return nil, fmt.Errorf("placeholder {%v} must be followed by a separator that isn't a digit", AT_VMID)
+	}
+
+	return parts, nil
+}
+
+// prefix renders the template up to {timestamp}.
+func (n archiveNaming) prefix(machineInfo ProxmoxCLI.MachineInfo) string {
+	prefix := ""
+	for _, part := range n.parts {
+		switch part.placeholder {
+		case "":
+			prefix += part.literal
+		case AT_Hostname:
+			prefix += n.hostname
+		case AT_Node:
+			prefix += archiveField(machineInfo.Node)
+		case AT_Type:
+			prefix += string(machineInfo.Type)
+		case AT_VMID:
+			prefix += strconv.FormatUint(machineInfo.VMID, 10)
+		case AT_Name:
+			prefix += archiveField(machineInfo.Name)
+		case AT_Job:
+			prefix += n.jobName
+		case AT_Timestamp:
+			return prefix
+		}
+	}
+	return prefix
+}
+
+func (n archiveNaming) archiveName(prefix string, ts time.Time, archiveExtension string) string {
+	archiveName := prefix + ts.In(n.location).Format(archiveTimestampLayout)
 	if archiveExtension != "" {
 		archiveName += "." + archiveExtension
 	}
 	return archiveName
 }
+
+// listGlob matches all the archives the job could have created, and possibly more.
+// The fixed parts of the template are kept all along, so that the archives of other hosts aren't listed.
+func (n archiveNaming) listGlob() string {
+	glob := ""
+	for _, part := range n.parts {
+		switch part.placeholder {
+		case "":
+			glob += part.literal
+		case AT_Hostname:
+			glob += n.hostname
+		case AT_Job:
+			glob += n.jobName
+		default:
+			if !strings.HasSuffix(glob, "*") {
+				glob += "*"
+			}
+		}
+	}
+	if !strings.HasSuffix(glob, "*") {
+		glob += "*"
+	}
+	return glob
+}
+
+// compile builds the regex that parse matches the archive names with.
+func (n archiveNaming) compile() *regexp.Regexp {
+	pattern := `^`
+	for _, part := range n.parts {
+		switch part.placeholder {
+		case "":
+			pattern += regexp.QuoteMeta(part.literal)
+		case AT_Hostname:
+			pattern += regexp.QuoteMeta(n.hostname)
+		case AT_Node, AT_Name:
+			pattern += `.+?`
+		case AT_Type:
+			pattern += `(?P<type>` + string(ProxmoxCLI.VM) + `|` + string(ProxmoxCLI.LXC) + `)`
+		case AT_VMID:
+			pattern += `(?P<vmid>\d+)`
+		case AT_Job:
+			pattern += regexp.QuoteMeta(n.jobName)
+		case AT_Timestamp:
+			pattern += `(?P<timestamp>` + archiveTimestampPattern + `)`
+		}
+	}
+	pattern += `(?:\.[\w.]+)?$`
+	return regexp.MustCompile(pattern)
+}
+
+// parse finds the VM/LXC an archive belongs to, if the archive was named by the same template.
+// machineType is empty if the template has no {type}.
+func (n archiveNaming) parse(archiveName string) (prefix string, machineType ProxmoxCLI.MachineType, vmid uint64, ok bool) {
+	regexArchiveName := n.pattern
+	m := regexArchiveName.FindStringSubmatchIndex(archiveName)
+	if m == nil {
+		return "", "", 0, false
+	}
+	group := func(name string) string {
+		i := regexArchiveName.SubexpIndex(name)
+		if i < 0 || m[2*i] < 0 {
+			return ""
+		}
+		return archiveName[m[2*i]:m[2*i+1]]
+	}
+
+	vmid, err := strconv.ParseUint(group("vmid"), 10, 64)
+	if err != nil {
+		return "", "", 0, false
+	}
+	return archiveName[:m[2*regexArchiveName.SubexpIndex("timestamp")]], ProxmoxCLI.MachineType(group("type")), vmid, true
+}
+
+// archiveTime reads the timestamp of an archive that starts with prefix.
+func (n archiveNaming) archiveTime(prefix string, archiveName string) (time.Time, bool) {
+	rest, ok := strings.CutPrefix(archiveName, prefix)
+	if !ok || len(rest) < len(archiveTimestampLayout) {
+		return time.Time{}, false
+	}
+	ts, err := time.ParseInLocation(archiveTimestampLayout, rest[:len(archiveTimestampLayout)], n.location)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return ts, true
+}
+
+func (bjd BackupJobData) archivePrefix() string {
+	return bjd.naming.prefix(bjd.Info)
+}
+
+func (bjd BackupJobData) archiveName(ts time.Time, archiveExtension string) string {
+	return bjd.naming.archiveName(bjd.archivePrefix(), ts, archiveExtension)
+}
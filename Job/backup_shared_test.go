@@ -0,0 +1,159 @@
+package Job
+
+import (
+	"borgmox/ProxmoxCLI"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testNaming builds the naming of job J1 on host pve1, failing the test on an invalid template.
+func testNaming(t *testing.T, template string) archiveNaming {
+	t.Helper()
+	naming, err := newArchiveNaming("J1", BackupJobSettings{
+		ArchivePrefix:       "pve1",
+		ArchiveNameTemplate: template,
+	})
+	if err != nil {
+		t.Fatalf("newArchiveNaming(%q): %v", template, err)
+	}
+	return naming
+}
+
+func TestParseArchiveNameTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		// A substring of the error, empty if the template is valid
+		err string
+	}{
+		{template: DefaultArchiveNameTemplate},
+		{template: "{hostname}-{job}-{type}-{vmid}-{timestamp}", err: "must come after {vmid}"},
+		{template: "{hostname}_{vmid}.{name}.{node}-{job}-{timestamp}"},
+		{template: "backup-{hostname}-{vmid}-{timestamp}"},
+		{template: "{hostname}-{vmid}-{timestamp}-x", err: "must end with {timestamp}"},
+		{template: "{hostname}-{vmid}{type}-{timestamp}", err: "must be separated"},
+		{template: "{hostname}-{vmid}0-{timestamp}", err: "isn't a digit"},
+		{template: "{hostname}-{type}-{timestamp}", err: "{vmid} is required"},
+		{template: "{hostname}-{vmid}-", err: "{timestamp} is required"},
+		{template: "{type}-{vmid}-{timestamp}", err: "{hostname} is required"},
+		{template: "{hostname}-{vmid}-{vmid}-{timestamp}", err: "more than once"},
+		{template: "{hostname}-{vmid}-{size}-{timestamp}", err: "unknown placeholder {size}"},
+		{template: "{hostname-{vmid}-{timestamp}", err: "unknown placeholder"},
+		{template: "{hostname}-{vmid}-{timestamp", err: "unmatched '{'"},
+		{template: "{hostname}}-{vmid}-{timestamp}", err: "unmatched '}'"},
+		{template: "{hostname}-*-{vmid}-{timestamp}", err: "can't contain"},
+		{template: "{hostname}-{vmid}-?{timestamp}", err: "can't contain"},
+		{template: "{hostname}-[{vmid}]-{timestamp}", err: "can't contain"},
+		{template: "{hostname}\\{vmid}-{timestamp}", err: "can't contain"},
+		{template: "{hostname}/{vmid}-{timestamp}", err: "can't contain"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.template, func(t *testing.T) {
+			_, err := parseArchiveNameTemplate(test.template)
+			if test.err == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Errorf("error = %v, want one containing %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestArchiveNamingParse(t *testing.T) {
+	tests := []struct {
+		template    string
+		archiveName string
+		prefix      string
+		machineType ProxmoxCLI.MachineType
+		vmid        uint64
+		ok          bool
+	}{
+		{
+			template:    DefaultArchiveNameTemplate,
+			archiveName: "pve1-qemu-100-2024_01_02-03_00_00.vma",
+			prefix:      "pve1-qemu-100-",
+			machineType: ProxmoxCLI.VM,
+			vmid:        100,
+			ok:          true,
+		},
+		{
+			template:    DefaultArchiveNameTemplate,
+			archiveName: "pve1-lxc-1000-2024_01_02-03_00_00.checkpoint",
+			prefix:      "pve1-lxc-1000-",
+			machineType: ProxmoxCLI.LXC,
+			vmid:        1000,
+			ok:          true,
+		},
+		{
+			template:    DefaultArchiveNameTemplate,
+			archiveName: "pve2-qemu-100-2024_01_02-03_00_00.vma",
+		},
+		{
+			template:    DefaultArchiveNameTemplate,
+			archiveName: "pve1-qemu-100-manual",
+		},
+		{
+			template:    "{hostname}-{vmid}-{name}-{job}-{timestamp}",
+			archiveName: "pve1-100-web-01-J1-2024_01_02-03_00_00.tar",
+			prefix:      "pve1-100-web-01-J1-",
+			vmid:        100,
+			ok:          true,
+		},
+		{
+			template:    "{hostname}-{vmid}-{name}-{job}-{timestamp}",
+			archiveName: "pve1-100-web-01-J2-2024_01_02-03_00_00.tar",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.archiveName, func(t *testing.T) {
+			prefix, machineType, vmid, ok := testNaming(t, test.template).parse(test.archiveName)
+			if ok != test.ok || prefix != test.prefix || machineType != test.machineType || vmid != test.vmid {
+				t.Errorf("parse = %q, %q, %v, %v, want %q, %q, %v, %v", prefix, machineType, vmid, ok, test.prefix, test.machineType, test.vmid, test.ok)
+			}
+		})
+	}
+}
+
+func TestArchiveNamingListGlob(t *testing.T) {
+	tests := []struct {
+		template string
+		glob     string
+	}{
+		{template: DefaultArchiveNameTemplate, glob: "pve1-*-*-*"},
+		{template: "{hostname}-{vmid}-{job}-{timestamp}", glob: "pve1-*-J1-*"},
+		{template: "{hostname}-{vmid}-{name}.{node}-{timestamp}", glob: "pve1-*-*.*-*"},
+		{template: "backup_{hostname}_{vmid}_{timestamp}", glob: "backup_pve1_*_*"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.template, func(t *testing.T) {
+			if glob := testNaming(t, test.template).listGlob(); glob != test.glob {
+				t.Errorf("listGlob = %q, want %q", glob, test.glob)
+			}
+		})
+	}
+}
+
+func TestArchiveNamingWithoutHostname(t *testing.T) {
+	parts, err := parseArchiveNameTemplate(DefaultArchiveNameTemplate)
+	if err != nil {
+		t.Fatalf("parseArchiveNameTemplate: %v", err)
+	}
+	naming := archiveNaming{parts: withoutHostname(parts), location: time.UTC}
+	naming.pattern = naming.compile()
+
+	// Like the archive names before the templates
+	info := ProxmoxCLI.MachineInfo{VMID: 100, Type: ProxmoxCLI.VM}
+	if prefix := naming.prefix(info); prefix != "qemu-100-" {
+		t.Errorf("prefix = %q, want %q", prefix, "qemu-100-")
+	}
+	if glob := naming.listGlob(); glob != "*-*-*" {
+		t.Errorf("listGlob = %q, want %q", glob, "*-*-*")
+	}
+	if prefix, _, vmid, ok := naming.parse("qemu-100-2024_01_02-03_00_00.vma"); !ok || prefix != "qemu-100-" || vmid != 100 {
+		t.Errorf("parse = %q, %v, %v", prefix, vmid, ok)
+	}
+}
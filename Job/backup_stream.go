@@ -0,0 +1,466 @@
+package Job
+
+import (
+	"borgmox/BorgCLI"
+	"borgmox/ProxmoxCLI"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// How many lines of vzdump/borg stderr are kept to explain a failure, unless GuestLogs.ErrorLines is set
+const stderrTailLines = 5
+
+// How much of the vzdump/borg stderr of a VM/LXC is kept for the notifications
+const guestOutputSize = 64 * 1024
+
+// tailBuffer keeps the last lines written to it, while forwarding everything to another writer.
+type tailBuffer struct {
+	mu      sync.Mutex
+	forward io.Writer
+	lines   []string
+	partial []byte
+	max     int
+}
+
+func newTailBuffer(forward io.Writer, max int) *tailBuffer {
+	return &tailBuffer{
+		forward: forward,
+		max:     max,
+	}
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.partial = append(t.partial, p...)
+	for {
+		// borg's progress output uses carriage returns to overwrite the same line
+		i := bytes.IndexAny(t.partial, "\r\n")
+		if i < 0 {
+			break
+		}
+		if line := strings.TrimSpace(string(t.partial[:i])); line != "" {
+			t.lines = append(t.lines, line)
+			if len(t.lines) > t.max {
+				t.lines = t.lines[len(t.lines)-t.max:]
+			}
+		}
+		t.partial = t.partial[i+1:]
+	}
+
+	if t.forward != nil {
+		return t.forward.Write(p)
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	lines := t.lines
+	if line := strings.TrimSpace(string(t.partial)); line != "" {
+		lines = append(lines[:len(lines):len(lines)], line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// wrap appends the captured lines to an error, leaving out the ones the error already says.
+func (t *tailBuffer) wrap(err error) error {
+	lines := []string{}
+	for _, line := range strings.Split(t.String(), "\n") {
+		if line != "" && !strings.Contains(err.Error(), strings.TrimPrefix(line, "ERROR: ")) {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) > 0 {
+		return fmt.Errorf("%w\n%v", err, strings.Join(lines, "\n"))
+	}
+	return err
+}
+
+// guestOutput captures the vzdump/borg stderr of a single VM/LXC, keeping only its end.
+// Progress updates overwrite their own line, so that they don't fill the buffer.
+type guestOutput struct {
+	mu   sync.Mutex
+	tail *logTail
+	line []byte
+}
+
+func newGuestOutput() *guestOutput {
+	return &guestOutput{tail: &logTail{size: guestOutputSize}}
+}
+
+func (g *guestOutput) Write(p []byte) (int, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var lines []byte
+	for _, c := range p {
+		switch c {
+		case '\r':
+			g.line = g.line[:0]
+		case '\n':
+			lines = append(append(lines, g.line...), '\n')
+			g.line = g.line[:0]
+		default:
+			g.line = append(g.line, c)
+		}
+	}
+	if len(lines) > 0 {
+		g.tail.Write(lines)
+	}
+	return len(p), nil
+}
+
+func (g *guestOutput) String() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return strings.TrimSpace(g.tail.String() + string(g.line))
+}
+
+// streamReader counts and hashes the backup stream while it's being read.
+type streamReader struct {
+	r     io.Reader
+	hash  hash.Hash
+	bytes uint64
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.bytes += uint64(n)
+	r.hash.Write(p[:n])
+	return n, err
+}
+
+const (
+	// How many chunks of the stream an archiver can lag behind the fastest one
+	teeBufferChunks = 64
+	// An archiver that accepts no data for this long is dropped, so that it doesn't hold up the others
+	teeStallTimeout = 5 * time.Minute
+)
+
+var errArchiverStalled = errors.New("borg stopped accepting data")
+
+// teeBranch feeds one archiver from its own goroutine.
+type teeBranch struct {
+	w      io.Writer
+	chunks chan []byte
+	// Closed once the goroutine stops, err is set by then
+	done chan struct{}
+	err  error
+}
+
+func (b *teeBranch) run() {
+	defer close(b.done)
+	for chunk := range b.chunks {
+		if _, err := b.w.Write(chunk); err != nil {
+			b.err = err
+			return
+		}
+	}
+}
+
+// teeWriter writes the same data to every repository archiver.
+// Each archiver has a bounded buffer, so a slow one doesn't slow down the others until its buffer is full.
+// A failing archiver, or one that stalls for teeStallTimeout, is dropped, while the others keep receiving data.
+type teeWriter struct {
+	branches     []*teeBranch
+	errors       []error
+	stallTimeout time.Duration
+	// Stops a stalled archiver, so that its pending write returns
+	stop func(i int)
+}
+
+func newTeeWriter(writers []io.Writer, stop func(i int)) *teeWriter {
+	t := &teeWriter{
+		branches:     make([]*teeBranch, len(writers)),
+		errors:       make([]error, len(writers)),
+		stallTimeout: teeStallTimeout,
+		stop:         stop,
+	}
+	for i, w := range writers {
+		t.branches[i] = &teeBranch{
+			w:      w,
+			chunks: make(chan []byte, teeBufferChunks),
+			done:   make(chan struct{}),
+		}
+		go t.branches[i].run()
+	}
+	return t
+}
+
+func (t *teeWriter) drop(i int) {
+	t.errors[i] = fmt.Errorf("%w for %v", errArchiverStalled, t.stallTimeout)
+	t.stop(i)
+}
+
+func (t *teeWriter) Write(p []byte) (int, error) {
+	// io.Copy reuses its buffer
+	chunk := bytes.Clone(p)
+
+	alive := 0
+	for i, b := range t.branches {
+		if t.errors[i] != nil {
+			continue
+		}
+		// A failed archiver may still have room in its buffer
+		select {
+		case <-b.done:
+			t.errors[i] = b.err
+			continue
+		default:
+		}
+		timer := time.NewTimer(t.stallTimeout)
+		select {
+		case b.chunks <- chunk:
+			alive++
+		case <-b.done:
+			t.errors[i] = b.err
+		case <-timer.C:
+			t.drop(i)
+		}
+		timer.Stop()
+	}
+
+	if alive == 0 {
+		return 0, errors.New("all archivers stopped accepting data")
+	}
+	return len(p), nil
+}
+
+// Close waits for every archiver to receive its buffered data. It doesn't close the archivers.
+func (t *teeWriter) Close() error {
+	for _, b := range t.branches {
+		close(b.chunks)
+	}
+
+	alive := 0
+	for i, b := range t.branches {
+		timer := time.NewTimer(t.stallTimeout)
+		select {
+		case <-b.done:
+			if t.errors[i] == nil {
+				t.errors[i] = b.err
+			}
+		case <-timer.C:
+			t.drop(i)
+			<-b.done
+		}
+		timer.Stop()
+		if t.errors[i] == nil {
+			alive++
+		}
+	}
+
+	if alive == 0 {
+		return errors.New("all archivers stopped accepting data")
+	}
+	return nil
+}
+
+type archiver struct {
+	repository BorgCLI.BorgSettings
+	cmd        *exec.Cmd
+	stdin      io.WriteCloser
+	stdout     *bytes.Buffer
+	stderr     *tailBuffer
+	borgLog    *BorgCLI.LogCollector
+	log        *logWriter
+}
+
+// wait waits for the archiver to exit, and returns the error logged by borg.
+func (a archiver) wait() error {
+	err := a.cmd.Wait()
+	a.borgLog.Close()
+	a.log.Close()
+	return a.borgLog.Err(err)
+}
+
+// finish waits for the archiver to exit, and reports its error along with its last stderr lines.
+// Warnings are returned as they are, the archive was still created.
+func (a archiver) finish(writeErr error) error {
+	err := a.wait()
+	if errors.Is(writeErr, errArchiverStalled) {
+		// borg was stopped because of the stall, which its own error doesn't tell
+		return a.stderr.wrap(fmt.Errorf("borg failed: %w", writeErr))
+	} else if err == nil {
+		err = writeErr
+	}
+	if isBorgWarning(err) {
+		return err
+	} else if err != nil {
+		return a.stderr.wrap(fmt.Errorf("borg failed: %w", err))
+	}
+	return nil
+}
+
+// archiveSettings leaves out --progress, its output can't be logged line by line.
+func archiveSettings() BorgCLI.CreateArchiveSettings {
+	return BorgCLI.CreateArchiveSettings{
+		Compression: "auto,zlib",
+		JSON:        true,
+	}
+}
+
+// runImageBackup dumps the guest once with vzdump, and streams the dump to all of the job's repositories.
+// The returned error only reflects the primary repository, replica failures are only reported in the RepositoryResults.
+// The stderr of vzdump and borg is logged line by line, and also written to output.
+func (s *JobData) runImageBackup(logger *slog.Logger, bjd BackupJobData, js BackupJobSettings, backupSettings ProxmoxCLI.StartImageBackupSettings, archiveExtension string, output io.Writer) (RepositoryResults, StreamStats, error) {
+	repositories := js.repositories()
+	ArchiveSettings := archiveSettings()
+
+	results := make(RepositoryResults, len(repositories))
+	stats := StreamStats{}
+
+	cmdBackup, err := ProxmoxCLI.StartImageBackup(bjd.Info.VMID, backupSettings)
+	if err != nil {
+		return results.failAll(repositories, err), stats, err
+	}
+
+	archiveName := bjd.archiveName(time.Now(), archiveExtension)
+	stats.Archive = archiveName
+
+	// Start an archiver for each repository
+	archivers := make([]archiver, 0, len(repositories))
+	for _, repository := range repositories {
+		a := archiver{
+			repository: repository,
+			stdout:     &bytes.Buffer{},
+			log:        newLogWriter(logger.With("repository", repository.Repository), "borg"),
+		}
+		a.stderr = newTailBuffer(io.MultiWriter(a.log, output), s.GuestLogs.errorLines())
+		a.borgLog = BorgCLI.NewLogCollector(a.stderr)
+		if a.cmd, err = BorgCLI.CreateArchiveStdin(repository, archiveName, ArchiveSettings); err != nil {
+			results[repository.Repository] = err
+			continue
+		}
+		if a.stdin, err = a.cmd.StdinPipe(); err != nil {
+			results[repository.Repository] = err
+			continue
+		}
+		a.cmd.Stdout = a.stdout
+		a.cmd.Stderr = a.borgLog
+
+		if err := a.cmd.Start(); err != nil {
+			results[repository.Repository] = fmt.Errorf("borg failed to start: %w", err)
+			continue
+		}
+		archivers = append(archivers, a)
+	}
+
+	if len(archivers) == 0 {
+		return results, stats, results[js.Borg.Repository]
+	}
+
+	writers := make([]io.Writer, len(archivers))
+	for i, a := range archivers {
+		writers[i] = a.stdin
+	}
+	tee := newTeeWriter(writers, func(i int) {
+		archivers[i].cmd.Process.Signal(syscall.SIGTERM)
+	})
+
+	// Stream the dump to the archivers
+	dumpLog := newLogWriter(logger, "vzdump")
+	defer dumpLog.Close()
+	dumpStderr := newTailBuffer(io.MultiWriter(dumpLog, output), s.GuestLogs.errorLines())
+	cmdBackup.Stderr = dumpStderr
+
+	stream := &streamReader{hash: sha256.New()}
+	started := time.Now()
+	err = ProxmoxCLI.StreamImageBackup(cmdBackup, func(dump *io.PipeReader) error {
+		stream.r = dump
+		_, err := io.Copy(tee, stream)
+		if closeErr := tee.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	})
+
+	stats.Bytes = stream.bytes
+	stats.Duration = time.Since(started)
+	stats.SHA256 = hex.EncodeToString(stream.hash.Sum(nil))
+
+	var producerErr *ProxmoxCLI.ProducerError
+	if errors.As(err, &producerErr) {
+		// borg would commit a truncated archive if its input was just closed
+		abortArchivers(archivers)
+		err = dumpStderr.wrap(producerErr)
+		return results.failAll(repositories, err), stats, err
+	} else if err != nil {
+		// Every archiver failed while the dump was still running
+		waitErrs := abortArchivers(archivers)
+		for i, a := range archivers {
+			if waitErrs[i] == nil || errors.Is(tee.errors[i], errArchiverStalled) {
+				waitErrs[i] = tee.errors[i]
+			}
+			results[a.repository.Repository] = a.stderr.wrap(fmt.Errorf("borg failed: %w", waitErrs[i]))
+		}
+		return results, stats, results[js.Borg.Repository]
+	}
+
+	for i, a := range archivers {
+		a.stdin.Close()
+		results[a.repository.Repository] = a.finish(tee.errors[i])
+
+		// borg warnings, i.e. a file that changed while it was read, still leave a complete archive
+		if err := results[a.repository.Repository]; a.repository.Repository == js.Borg.Repository && (err == nil || isBorgWarning(err)) {
+			if createStats, err := BorgCLI.ParseCreateStats(a.stdout.Bytes()); err != nil {
+				logger.Warn("Cannot read the deduplicated size", "repository", a.repository.Repository, "error", err)
+			} else {
+				stats.Deduplicated = createStats.DeduplicatedSize
+			}
+		}
+	}
+
+	logStreamStats(logger, stats)
+	return results, stats, results[js.Borg.Repository]
+}
+
+// abortArchivers stops the archivers, and returns the error of each one.
+func abortArchivers(archivers []archiver) []error {
+	for _, a := range archivers {
+		a.cmd.Process.Signal(syscall.SIGTERM)
+	}
+	errs := make([]error, len(archivers))
+	for i, a := range archivers {
+		a.stdin.Close()
+		errs[i] = a.wait()
+	}
+	return errs
+}
+
+func logStreamStats(logger *slog.Logger, stats StreamStats) {
+	logger.Info("Backed up",
+		"size", formatBytes(float64(stats.Bytes)),
+		"duration", stats.Duration.Round(time.Second),
+		"throughput", formatBytes(stats.Throughput())+"/s",
+		"deduplicated", formatBytes(float64(stats.Deduplicated)),
+		"sha256", stats.SHA256,
+	)
+}
+
+func formatBytes(b float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for b >= 1024 && i < len(units)-1 {
+		b /= 1024
+		i++
+	}
+	return strconv.FormatFloat(b, 'f', 2, 64) + " " + units[i]
+}
@@ -0,0 +1,109 @@
+package Job
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockedBuffer is a bytes.Buffer that the tee can write to from its goroutines.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// failingWriter refuses every write.
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+func TestTeeWriterDropsStalledArchiver(t *testing.T) {
+	primary := &lockedBuffer{}
+	// Nobody reads the replica, like a borg process stuck on a hung connection
+	stalledReader, stalled := io.Pipe()
+
+	stopped := []int{}
+	tee := newTeeWriter([]io.Writer{primary, stalled}, func(i int) {
+		stopped = append(stopped, i)
+		stalledReader.CloseWithError(errors.New("terminated"))
+	})
+	tee.stallTimeout = 50 * time.Millisecond
+
+	data := strings.Repeat("x", 1024)
+	for i := 0; i < teeBufferChunks+10; i++ {
+		if _, err := tee.Write([]byte(data)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if err := tee.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if got, want := len(primary.String()), (teeBufferChunks+10)*len(data); got != want {
+		t.Errorf("primary received %v bytes, want %v", got, want)
+	}
+	if tee.errors[0] != nil {
+		t.Errorf("primary failed: %v", tee.errors[0])
+	}
+	if !errors.Is(tee.errors[1], errArchiverStalled) {
+		t.Errorf("replica error = %v, want a stall", tee.errors[1])
+	}
+	if len(stopped) != 1 || stopped[0] != 1 {
+		t.Errorf("stopped archivers %v, want [1]", stopped)
+	}
+}
+
+func TestTeeWriterDropsFailedArchiver(t *testing.T) {
+	primary := &lockedBuffer{}
+	tee := newTeeWriter([]io.Writer{failingWriter{}, primary}, func(i int) {
+		t.Errorf("archiver %v was stopped, it only failed", i)
+	})
+
+	for i := 0; i < 3; i++ {
+		if _, err := tee.Write([]byte("data")); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if err := tee.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if primary.String() != "datadatadata" {
+		t.Errorf("primary received %q", primary.String())
+	}
+	if tee.errors[0] == nil || tee.errors[1] != nil {
+		t.Errorf("errors = %v, want only the first archiver to fail", tee.errors)
+	}
+}
+
+func TestTeeWriterFailsWithoutArchivers(t *testing.T) {
+	tee := newTeeWriter([]io.Writer{failingWriter{}}, func(i int) {})
+
+	// The first chunk is only buffered, the failure shows up later
+	tee.Write([]byte("data"))
+	<-tee.branches[0].done
+	if _, err := tee.Write([]byte("data")); err == nil {
+		t.Error("Write succeeded without any archiver left")
+	}
+	if err := tee.Close(); err == nil {
+		t.Error("Close succeeded without any archiver left")
+	}
+}
@@ -0,0 +1,172 @@
+package Job
+
+import (
+	"borgmox/BorgCLI"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+)
+
+func (s *JobData) runCheck(logger *slog.Logger, repository BorgCLI.BorgSettings) (BorgCLI.CheckResult, error) {
+	var cmdRunAll *exec.Cmd
+	var err error
+
+	if cmdRunAll, err = BorgCLI.Check(repository); err != nil {
+		return BorgCLI.CheckResult{}, err
+	}
+
+	// borg check logs everything to stderr; keep a copy of it to find out what went wrong.
+	var output bytes.Buffer
+	checkLog := newLogWriter(logger, "borg")
+	borgLog := BorgCLI.NewLogCollector(io.MultiWriter(checkLog, &output))
+	cmdRunAll.Stdout = io.MultiWriter(checkLog, &output)
+	cmdRunAll.Stderr = borgLog
+
+	logger.Info("Now checking borg repository", "mode", checkModeName(repository.Check))
+	err = cmdRunAll.Run()
+	borgLog.Close()
+	checkLog.Close()
+	err = borgLog.Err(err)
+
+	checkResult := BorgCLI.ParseCheckOutput(output.String())
+	if err != nil {
+		// The error already says the last problem borg logged
+		problems := []string{}
+		for _, problem := range checkResult.Problems {
+			if !strings.Contains(err.Error(), problem) {
+				problems = append(problems, problem)
+			}
+		}
+		if len(problems) > 0 {
+			return checkResult, fmt.Errorf("%w: %v", err, strings.Join(problems, "; "))
+		}
+		return checkResult, err
+	}
+
+	return checkResult, nil
+}
+
+func checkModeName(settings BorgCLI.BorgCheckSettings) string {
+	name := string(settings.Mode)
+	if name == "" {
+		name = string(BorgCLI.CHK_Full)
+	}
+	if settings.VerifyData {
+		name += ", verify data"
+	}
+	if settings.MaxDuration > 0 {
+		name += fmt.Sprintf(", max %v seconds", settings.MaxDuration)
+	}
+	return name
+}
+
+// checkJob runs the repository checks of a Backup Job.
+// With afterJob, only the repositories that should be checked at the end of a job are considered.
+func (s *JobData) checkJob(jobName string, js BackupJobSettings, state *persistentState, force bool, afterJob bool, checkedRepositories map[string]error, result *JobResult) {
+	var errs []error
+	for _, repository := range js.repositories() {
+		if !repository.Check.Enabled || (afterJob && !repository.Check.AfterJob) {
+			continue
+		}
+		if err := s.checkRepository(jobName, js, repository, state, force, checkedRepositories, result); err != nil {
+			errs = append(errs, fmt.Errorf("%v: %w", repository.Repository, err))
+		}
+	}
+	result.FailedCheck = errors.Join(errs...)
+}
+
+// checkRepository runs the check of a single repository, unless it already ran recently
+// or the repository was already checked during this run.
+func (s *JobData) checkRepository(jobName string, js BackupJobSettings, repository BorgCLI.BorgSettings, state *persistentState, force bool, checkedRepositories map[string]error, result *JobResult) error {
+	if err, ok := checkedRepositories[repository.Repository]; ok {
+		return err
+	}
+
+	logger := jobLogger(jobName, NPH_Check).With("repository", repository.Repository)
+	now := time.Now()
+	if lastCheck := state.LastCheck[repository.Repository]; !force && !isDue(lastCheck, repository.Check.EveryDays, now) {
+		logger.Info("Skipping the repository check", "last_check", lastCheck.Format(time.RFC3339))
+		return nil
+	}
+
+	result.CheckRan = true
+	checkResult, err := s.runCheck(logger, repository)
+	checkedRepositories[repository.Repository] = err
+
+	event := NotificationEvent{
+		Job:        jobName,
+		Phase:      NPH_Check,
+		Outcome:    NO_Success,
+		Repository: repository.Repository,
+		Check:      checkResult,
+	}
+	if err != nil {
+		event.Outcome = NO_Failure
+		event.Error = err
+		s.notify(js, event, result)
+		return err
+	}
+
+	state.LastCheck[repository.Repository] = now
+	result.SucceededChecks = append(result.SucceededChecks, repository.Repository)
+	s.notify(js, event, result)
+	return nil
+}
+
+// hasCheck reports whether any repository of the job has its check enabled.
+func (js BackupJobSettings) hasCheck(afterJob bool) bool {
+	for _, repository := range js.repositories() {
+		if repository.Check.Enabled && (!afterJob || repository.Check.AfterJob) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *JobData) RunCheck(options CheckOptions) map[string]JobResult {
+	jobResults := make(map[string]JobResult, len(s.BackupJobs))
+	checkedRepositories := make(map[string]error, len(s.BackupJobs))
+
+	state, err := s.loadState()
+	if err != nil {
+		jobLogger("", NPH_Check).Warn("Cannot load the previous state, all repository checks are due", "error", err)
+	}
+
+	for jobName, jobSettings := range s.BackupJobs {
+		if len(options.Jobs) > 0 && !slices.Contains(options.Jobs, jobName) {
+			continue
+		}
+		if !jobSettings.hasCheck(false) {
+			if len(options.Jobs) > 0 {
+				jobResults[jobName] = JobResult{
+					Error: fmt.Errorf("repository check is disabled in Backup Job %v", jobName),
+				}
+			}
+			continue
+		}
+
+		result := JobResult{}
+		s.checkJob(jobName, jobSettings, state, options.Force, false, checkedRepositories, &result)
+		jobResults[jobName] = result
+	}
+
+	for _, jobName := range options.Jobs {
+		if _, ok := s.BackupJobs[jobName]; !ok {
+			jobResults[jobName] = JobResult{
+				Error: fmt.Errorf("backup job %v does not exist", jobName),
+			}
+		}
+	}
+
+	if err := state.save(); err != nil {
+		slog.Error("Cannot save the current state", "error", err)
+	}
+
+	return jobResults
+}
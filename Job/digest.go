@@ -0,0 +1,166 @@
+package Job
+
+import (
+	"errors"
+	"time"
+)
+
+// DigestSettings sends a single notification at the end of a run, summing up every job.
+// Frequency must be "single job" to enable it, the priorities follow the worst outcome of the run.
+type DigestSettings struct {
+	NotificationTargetInfo
+	// The digest has its own routing, its notifiers only have a Type, templates and settings
+	Notifications []NotifierBackend
+}
+
+// DigestJob is a row of the digest table.
+type DigestJob struct {
+	Job     string
+	Outcome NotificationOutcome
+	Error   string
+
+	Backups          int
+	SucceededBackups int
+	Prunes           int
+	SucceededPrunes  int
+	// "ok", "failed", or "-" when the job doesn't compact
+	Compact string
+
+	Bytes        uint64
+	Deduplicated uint64
+	Duration     time.Duration
+}
+
+// DigestGuest is a VM/LXC that stands out in the digest.
+type DigestGuest struct {
+	Job string
+	NotificationGuest
+}
+
+// RunDigest sums up every job of a run.
+type RunDigest struct {
+	Jobs  []DigestJob
+	Total DigestJob
+	// The backup that took the longest, and the one that added the most to its repository
+	Slowest       *DigestGuest
+	LargestGrowth *DigestGuest
+}
+
+// worseOutcome returns the worst of two outcomes.
+func worseOutcome(a NotificationOutcome, b NotificationOutcome) NotificationOutcome {
+	rank := map[NotificationOutcome]int{NO_Success: 0, NO_Partial: 1, NO_Failure: 2}
+	if rank[b] > rank[a] {
+		return b
+	}
+	return a
+}
+
+// digestJob sums up the result of a job.
+func (r JobResult) digestJob(jobName string) DigestJob {
+	row := DigestJob{
+		Job:              jobName,
+		Outcome:          NO_Success,
+		Error:            errorString(r.Error),
+		Backups:          len(r.SucceededBackups) + len(r.FailedBackups),
+		SucceededBackups: len(r.SucceededBackups),
+		Prunes:           len(r.SucceededPrunes) + len(r.FailedPrunes),
+		SucceededPrunes:  len(r.SucceededPrunes),
+		Compact:          "-",
+	}
+	if r.CompactRan {
+		row.Compact = "ok"
+		if r.FailedCompact != nil {
+			row.Compact = "failed"
+		}
+	}
+	// Failed backups only count for the time they took
+	for vmid, stats := range r.BackupStats {
+		if _, ok := r.SucceededBackups[vmid]; ok {
+			row.Bytes += stats.Bytes
+			row.Deduplicated += stats.Deduplicated
+		}
+		row.Duration += stats.Duration
+	}
+
+	if r.Error != nil || (row.Backups > 0 && row.SucceededBackups == 0) {
+		row.Outcome = NO_Failure
+	} else if r.IsFailed() {
+		row.Outcome = NO_Partial
+	}
+	return row
+}
+
+// newRunDigest builds the digest of the jobs that ran.
+func (s *JobData) newRunDigest(results map[string]JobResult) *RunDigest {
+	digest := &RunDigest{
+		Total: DigestJob{
+			Job:     "Total",
+			Outcome: NO_Success,
+			Compact: "-",
+		},
+	}
+
+	for _, jobName := range sortedJobNames(s.BackupJobs) {
+		result, ok := results[jobName]
+		if !ok {
+			continue
+		}
+		row := result.digestJob(jobName)
+		digest.Jobs = append(digest.Jobs, row)
+
+		digest.Total.Outcome = worseOutcome(digest.Total.Outcome, row.Outcome)
+		digest.Total.Backups += row.Backups
+		digest.Total.SucceededBackups += row.SucceededBackups
+		digest.Total.Prunes += row.Prunes
+		digest.Total.SucceededPrunes += row.SucceededPrunes
+		digest.Total.Bytes += row.Bytes
+		digest.Total.Deduplicated += row.Deduplicated
+		digest.Total.Duration += row.Duration
+
+		event := NotificationEvent{
+			Machines:    result.Machines,
+			BackupStats: result.BackupStats,
+		}
+		for _, vmid := range sortedVMIDs(result.SucceededBackups) {
+			stats := result.BackupStats[vmid]
+			if digest.Slowest == nil || stats.Duration > digest.Slowest.Duration {
+				digest.Slowest = &DigestGuest{Job: jobName, NotificationGuest: event.guest(vmid)}
+			}
+			if digest.LargestGrowth == nil || stats.Deduplicated > digest.LargestGrowth.Deduplicated {
+				digest.LargestGrowth = &DigestGuest{Job: jobName, NotificationGuest: event.guest(vmid)}
+			}
+		}
+	}
+	return digest
+}
+
+// SendDigest sends the digest of a run to the Digest notifiers, and returns the delivery errors,
+// which are also added to FailedNotifications. Undelivered digests are spooled like any other notification.
+func (s *JobData) SendDigest(results map[string]JobResult) []error {
+	if !s.Digest.isEnabled() || len(s.Digest.Notifications) == 0 || len(results) == 0 {
+		return nil
+	}
+
+	digest := s.newRunDigest(results)
+	event := NotificationEvent{
+		Phase:     NPH_Digest,
+		Outcome:   digest.Total.Outcome,
+		Frequency: NF_EntireJobFinished,
+		Digest:    digest,
+	}
+	for _, row := range digest.Jobs {
+		if row.Error != "" {
+			event.Error = errors.Join(event.Error, errors.New(row.Job+": "+row.Error))
+		}
+	}
+
+	jobLogger("", NPH_Digest).Info("Sending the digest of the run", "outcome", string(event.Outcome))
+	var errs []error
+	for _, settings := range s.Digest.Notifications {
+		if err := s.notifyOne(settings, s.Digest.NotificationTargetInfo, event); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	s.failedNotifications = append(s.failedNotifications, errs...)
+	return errs
+}
@@ -0,0 +1,314 @@
+package Job
+
+import (
+	"borgmox/BorgCLI"
+	"borgmox/ProxmoxCLI"
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+const redactedValue = "<redacted>"
+
+// formatCommand prints a command line that can be pasted into a shell, without revealing the passphrase.
+func formatCommand(cmd *exec.Cmd) string {
+	parts := []string{}
+	for _, env := range cmd.Env {
+		if strings.HasPrefix(env, "BORG_PASSPHRASE=") {
+			parts = append(parts, "BORG_PASSPHRASE="+redactedValue)
+		}
+	}
+	for _, arg := range cmd.Args {
+		parts = append(parts, shellQuote(arg))
+	}
+	return strings.Join(parts, " ")
+}
+
+func shellQuote(arg string) string {
+	if arg != "" && strings.IndexFunc(arg, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./:=,@+%", r))
+	}) < 0 {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+func sortedJobNames(jobs map[string]BackupJobSettings) []string {
+	names := make([]string, 0, len(jobs))
+	for name := range jobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// dryRun prints everything RunJob would execute, without dumping any VM/LXC or modifying any repository.
+// The only commands that are actually run are read-only: pool listings and "borg prune --dry-run".
+func (s *JobData) dryRun(options JobOptions, out io.Writer) map[string]JobResult {
+	jobResults := make(map[string]JobResult, len(s.BackupJobs))
+	skippedMachines := make(map[uint64]struct{}, 64)
+	now := time.Now()
+
+	jobMachines := make(map[string]map[uint64]BackupJobData, len(s.BackupJobs))
+	jobErrors := make(map[string]error)
+	for jobName, jobSettings := range s.BackupJobs {
+		if machines, err := s.resolveMachines(jobName, jobSettings, skippedMachines); err != nil {
+			jobErrors[jobName] = err
+		} else {
+			jobMachines[jobName] = machines
+		}
+	}
+	active := s.newActiveArchives(jobMachines)
+	compactedBy := make(map[string]string)
+	resolvedJobs := []string{}
+	for _, jobName := range sortedJobNames(s.BackupJobs) {
+		if _, ok := jobMachines[jobName]; ok {
+			resolvedJobs = append(resolvedJobs, jobName)
+		}
+	}
+	orphanScans, orphanShared := s.orphanScans(resolvedJobs)
+
+	for _, jobName := range sortedJobNames(s.BackupJobs) {
+		jobSettings := s.BackupJobs[jobName]
+		fmt.Fprintf(out, "Backup Job %v\n", jobName)
+
+		machines, ok := jobMachines[jobName]
+		if !ok {
+			fmt.Fprintf(out, "  ERROR: %v\n\n", jobErrors[jobName])
+			jobResults[jobName] = JobResult{
+				Error: jobErrors[jobName],
+			}
+			continue
+		}
+
+		result := JobResult{
+			FailedBackups:   make(map[uint64]error, len(machines)),
+			SucceededPrunes: make(map[uint64]struct{}, len(machines)),
+			FailedPrunes:    make(map[uint64]error, len(machines)),
+		}
+		repositories := jobSettings.repositories()
+		keys := sortedMapKeys(machines)
+
+		if len(keys) == 0 {
+			fmt.Fprintf(out, "  No VMs/LXCs found in pools %v\n", strings.Join(jobSettings.VmPool, ", "))
+		}
+
+		if !options.DontBackup {
+			for _, key := range keys {
+				if err := s.planBackup(jobName, machines[key], jobSettings, now, out); err != nil {
+					fmt.Fprintf(out, "    ERROR: %v\n", err)
+					result.FailedBackups[key] = err
+				}
+			}
+		}
+
+		if !options.DontPrune {
+			if err := jobSettings.staleOverrides(jobName, machines); err != nil {
+				for _, line := range strings.Split(err.Error(), "\n") {
+					fmt.Fprintf(out, "  Stale %v\n", line)
+				}
+			}
+			if jobSettings.hasPrune() {
+				for _, key := range keys {
+					if err := s.planPrunes(machines[key], repositories, jobSettings, out); err != nil {
+						result.FailedPrunes[key] = err
+					} else {
+						result.SucceededPrunes[key] = struct{}{}
+					}
+				}
+			}
+
+			s.planOrphans(jobName, jobSettings, orphanScans[jobName], orphanShared[jobName], active, out)
+
+			for _, repository := range repositories {
+				if !repository.Prune.Enabled || !repository.Prune.Compact {
+					continue
+				}
+				if owner, ok := compactedBy[repository.Repository]; ok {
+					fmt.Fprintf(out, "  Compact %v: once, see Backup Job %v\n", repository.Repository, owner)
+					continue
+				}
+				compactedBy[repository.Repository] = jobName
+				if repository.Prune.CompactEveryDays > 0 {
+					fmt.Fprintf(out, "  Compact %v (every %v days), after all jobs have pruned\n", repository.Repository, repository.Prune.CompactEveryDays)
+				} else {
+					fmt.Fprintf(out, "  Compact %v, after all jobs have pruned\n", repository.Repository)
+				}
+				if cmd, err := BorgCLI.Compact(repository); err != nil {
+					fmt.Fprintf(out, "    ERROR: %v\n", err)
+					result.FailedCompact = err
+				} else {
+					fmt.Fprintf(out, "    %v\n", formatCommand(cmd))
+				}
+			}
+		}
+
+		if jobSettings.hasCheck(true) && !options.DontCheck {
+			for _, repository := range repositories {
+				if !repository.Check.Enabled || !repository.Check.AfterJob {
+					continue
+				}
+				fmt.Fprintf(out, "  Check %v (every %v days)\n", repository.Repository, repository.Check.EveryDays)
+				if cmd, err := BorgCLI.Check(repository); err != nil {
+					fmt.Fprintf(out, "    ERROR: %v\n", err)
+					result.FailedCheck = err
+				} else {
+					fmt.Fprintf(out, "    %v\n", formatCommand(cmd))
+				}
+			}
+		}
+
+		fmt.Fprintln(out)
+		jobResults[jobName] = result
+	}
+
+	return jobResults
+}
+
+func (s *JobData) planBackup(jobName string, bjd BackupJobData, js BackupJobSettings, now time.Time, out io.Writer) error {
+	var backupSettings ProxmoxCLI.StartImageBackupSettings
+	var archiveExtension string
+	var err error
+
+	switch bjd.Info.Type {
+	case ProxmoxCLI.VM:
+		backupSettings, archiveExtension, err = vmBackupSettings(jobName, bjd, js)
+	case ProxmoxCLI.LXC:
+		backupSettings, archiveExtension, err = lxcBackupSettings(jobName, bjd, js)
+	}
+
+	archiveName := bjd.archiveName(now, archiveExtension)
+	fmt.Fprintf(out, "  %v %v (%v): archive %v\n", machineTypeName(bjd.Info.Type), bjd.Info.Name, bjd.Info.VMID, archiveName)
+	if err != nil {
+		return err
+	}
+
+	cmdBackup, err := ProxmoxCLI.StartImageBackup(bjd.Info.VMID, backupSettings)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "    %v\n", formatCommand(cmdBackup))
+
+	for _, repository := range js.repositories() {
+		cmd, err := BorgCLI.CreateArchiveStdin(repository, archiveName, archiveSettings())
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "    | %v\n", formatCommand(cmd))
+	}
+	return nil
+}
+
+// planPrunes prints the prune commands of a guest, and asks borg which archives they would delete.
+func (s *JobData) planPrunes(bjd BackupJobData, repositories []BorgCLI.BorgSettings, js BackupJobSettings, out io.Writer) error {
+	var firstErr error
+
+	for _, repository := range repositories {
+		if !repository.Prune.Enabled {
+			continue
+		}
+
+		fmt.Fprintf(out, "  Prune %v %v (%v) in %v\n", machineTypeName(bjd.Info.Type), bjd.Info.Name, bjd.Info.VMID, repository.Repository)
+		if err := s.planPrune(js.pruneSettings(repository, bjd.Info), bjd.archivePrefix(), "    ", out); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// planPrune prints the prune command of archivePrefix in a repository whose keep-policy is already resolved,
+// the archives it would delete, and whether the guards would refuse it.
+func (s *JobData) planPrune(repository BorgCLI.BorgSettings, archivePrefix string, indent string, out io.Writer) error {
+	cmd, err := BorgCLI.PruneByPrefix(repository, archivePrefix)
+	if err != nil {
+		fmt.Fprintf(out, "%vERROR: %v\n", indent, err)
+		return err
+	}
+	fmt.Fprintf(out, "%v%v\n", indent, formatCommand(cmd))
+
+	list, err := s.listPrune(repository, archivePrefix)
+	if err != nil {
+		fmt.Fprintf(out, "%vERROR: %v\n", indent, err)
+		return err
+	}
+
+	fmt.Fprintf(out, "%v%v archives kept, %v archives would be deleted\n", indent, len(list.Keep), len(list.Delete))
+	for _, archive := range list.Delete {
+		fmt.Fprintf(out, "%v- %v\n", indent, archive)
+	}
+	if err := checkPruneGuards(repository, list); err != nil {
+		fmt.Fprintf(out, "%vGUARD: %v\n", indent, err)
+		return err
+	}
+	return nil
+}
+
+// listPrune runs "borg prune --dry-run --list" for archivePrefix in a repository whose keep-policy is already resolved,
+// and returns the archives it would keep and delete.
+func (s *JobData) listPrune(repository BorgCLI.BorgSettings, archivePrefix string) (BorgCLI.PruneList, error) {
+	cmd, err := BorgCLI.PruneByPrefixDryRun(repository, archivePrefix)
+	if err != nil {
+		return BorgCLI.PruneList{}, err
+	}
+
+	// borg prints the list through its logger, on stderr
+	var output bytes.Buffer
+	stderr := newTailBuffer(&output, s.GuestLogs.errorLines())
+	borgLog := BorgCLI.NewLogCollector(stderr)
+	cmd.Stdout = stderr
+	cmd.Stderr = borgLog
+
+	err = cmd.Run()
+	borgLog.Close()
+	if err := borgLog.Err(err); err != nil && !isBorgWarning(err) {
+		return BorgCLI.PruneList{}, stderr.wrap(fmt.Errorf("borg prune --dry-run failed: %w", err))
+	}
+
+	return BorgCLI.ParsePruneList(output.String()), nil
+}
+
+// planOrphans prints the orphaned archives of the job, and what the OrphanPolicy would do with them.
+// The repositories in shared are looked through by another job, see orphanScans.
+func (s *JobData) planOrphans(jobName string, js BackupJobSettings, repositories []BorgCLI.BorgSettings, shared map[string]string, active activeArchives, out io.Writer) {
+	if !js.hasOrphanPass() {
+		return
+	}
+
+	for _, repository := range js.repositories() {
+		if owner, ok := shared[repository.Repository]; ok {
+			fmt.Fprintf(out, "  Orphaned archives in %v: once, see Backup Job %v\n", repository.Repository, owner)
+		}
+	}
+
+	naming, err := newArchiveNaming(jobName, js)
+	if err != nil {
+		fmt.Fprintf(out, "  Orphaned archives: ERROR: %v\n", err)
+		return
+	}
+	for _, repository := range repositories {
+		fmt.Fprintf(out, "  Orphaned archives in %v (policy: %v)\n", repository.Repository, string(js.OrphanPolicy))
+		orphans, err := s.findOrphans(repository, naming, active)
+		if err != nil {
+			fmt.Fprintf(out, "    ERROR: %v\n", err)
+			continue
+		}
+		if len(orphans) == 0 {
+			fmt.Fprintf(out, "    None\n")
+		}
+
+		for _, orphan := range orphans {
+			fmt.Fprintf(out, "    %v %v: %v archives\n", machineTypeName(orphan.Type), orphan.VMID, orphan.Archives)
+			if js.OrphanPolicy != OP_Prune || !repository.Prune.Enabled || !active.complete {
+				continue
+			}
+
+			pruneRepository := repository
+			pruneRepository.Prune.BorgKeepSettings = js.OrphanPrune
+			s.planPrune(pruneRepository, orphan.Prefix, "      ", out)
+		}
+	}
+}
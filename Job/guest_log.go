@@ -0,0 +1,225 @@
+package Job
+
+import (
+	"borgmox/ProxmoxCLI"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	guestLogDirectoryName = "logs"
+	defaultGuestLogRuns   = 14
+	// Run directories are named after the start of the run, then the first part of the run ID
+	guestLogRunFormat = "2006-01-02T15-04-05"
+)
+
+// GuestLogSettings keeps the log of every VM/LXC backup, vzdump and borg output included, in a directory per run.
+type GuestLogSettings struct {
+	Enabled bool
+	// Defaults to "logs" in the StateDirectory
+	Directory string
+	// How many run directories are kept, defaults to 14
+	KeepRuns uint64
+	// The log of a VM/LXC is rotated once it's larger than MaxSize MiB, keeping one old file. 0 never rotates
+	MaxSize uint64
+	// How many lines of vzdump/borg output are added to the error of a failed backup, prune or compact.
+	// Also used when Enabled is false, defaults to 5
+	ErrorLines uint64
+}
+
+func (g GuestLogSettings) errorLines() int {
+	if g.ErrorLines == 0 {
+		return stderrTailLines
+	}
+	return int(g.ErrorLines)
+}
+
+func (g GuestLogSettings) keepRuns() int {
+	if g.KeepRuns == 0 {
+		return defaultGuestLogRuns
+	}
+	return int(g.KeepRuns)
+}
+
+func (s *JobData) guestLogDirectory() string {
+	if s.GuestLogs.Directory == "" {
+		return filepath.Join(s.stateDirectory(), guestLogDirectoryName)
+	}
+	return s.GuestLogs.Directory
+}
+
+// guestLogRun names the directory of the current run.
+func (s *JobData) guestLogRun(started time.Time) string {
+	return started.UTC().Format(guestLogRunFormat) + "-" + s.runID[:8]
+}
+
+// isGuestLogRun reports whether a directory was created by guestLogRun, the others are never removed.
+func isGuestLogRun(name string) bool {
+	if len(name) != len(guestLogRunFormat)+9 || name[len(guestLogRunFormat)] != '-' {
+		return false
+	}
+	_, err := time.Parse(guestLogRunFormat, name[:len(guestLogRunFormat)])
+	return err == nil
+}
+
+// rotatingFile is a log file that's moved to "<path>.1" once it grows past its maximum size.
+type rotatingFile struct {
+	mutex   sync.Mutex
+	path    string
+	file    *os.File
+	size    int64
+	maxSize int64
+}
+
+func openRotatingFile(path string, maxSize int64) (*rotatingFile, error) {
+	f := &rotatingFile{
+		path:    path,
+		maxSize: maxSize,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		f.file.Close()
+		f.file = nil
+		if err := os.Rename(f.path, f.path+".1"); err != nil {
+			return 0, err
+		}
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// teeHandler sends every record to two handlers, each with its own level.
+type teeHandler struct {
+	first  slog.Handler
+	second slog.Handler
+}
+
+func (h *teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.first.Enabled(ctx, level) || h.second.Enabled(ctx, level)
+}
+
+func (h *teeHandler) Handle(ctx context.Context, record slog.Record) error {
+	var errs []error
+	if h.first.Enabled(ctx, record.Level) {
+		errs = append(errs, h.first.Handle(ctx, record.Clone()))
+	}
+	if h.second.Enabled(ctx, record.Level) {
+		errs = append(errs, h.second.Handle(ctx, record.Clone()))
+	}
+	return errors.Join(errs...)
+}
+
+func (h *teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &teeHandler{first: h.first.WithAttrs(attrs), second: h.second.WithAttrs(attrs)}
+}
+
+func (h *teeHandler) WithGroup(name string) slog.Handler {
+	return &teeHandler{first: h.first.WithGroup(name), second: h.second.WithGroup(name)}
+}
+
+// openGuestLog opens the log file of a VM/LXC backup, and returns a logger that also writes to it.
+// Without GuestLogs, or when the file can't be opened, the logger is returned as is along with a nil file.
+func (s *JobData) openGuestLog(logger *slog.Logger, jobName string, info ProxmoxCLI.MachineInfo) (*slog.Logger, *rotatingFile) {
+	if !s.GuestLogs.Enabled || s.guestLogRunDirectory == "" {
+		return logger, nil
+	}
+
+	name := fmt.Sprintf("%v-%v-%v.log", archiveField(jobName), machineTypeName(info.Type), info.VMID)
+	path := filepath.Join(s.guestLogDirectory(), s.guestLogRunDirectory, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		logger.Error("Cannot create the log directory of the run", "error", err)
+		return logger, nil
+	}
+	file, err := openRotatingFile(path, int64(s.GuestLogs.MaxSize)*1024*1024)
+	if err != nil {
+		logger.Error("Cannot open the log file of the backup", "error", err)
+		return logger, nil
+	}
+
+	// The file keeps every level, and doesn't repeat what its name already says
+	fileHandler := slog.NewTextHandler(file, &slog.HandlerOptions{Level: slog.LevelDebug})
+	return slog.New(&teeHandler{first: logger.Handler(), second: fileHandler}), file
+}
+
+// pruneGuestLogs removes the oldest run directories, keeping KeepRuns of them.
+func (s *JobData) pruneGuestLogs() {
+	if !s.GuestLogs.Enabled {
+		return
+	}
+
+	directory := s.guestLogDirectory()
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Error("Cannot read the log directory", "directory", directory, "error", err)
+		}
+		return
+	}
+
+	runs := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() && isGuestLogRun(entry.Name()) {
+			runs = append(runs, entry.Name())
+		}
+	}
+	sort.Strings(runs)
+
+	for len(runs) > s.GuestLogs.keepRuns() {
+		path := filepath.Join(directory, runs[0])
+		if err := os.RemoveAll(path); err != nil {
+			slog.Error("Cannot remove an old log directory", "directory", path, "error", err)
+		}
+		runs = runs[1:]
+	}
+}
@@ -0,0 +1,267 @@
+package Job
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type HeartbeatPreset string
+type HeartbeatEvent string
+
+const (
+	HP_Healthchecks HeartbeatPreset = "healthchecks"
+	HP_UptimeKuma   HeartbeatPreset = "uptime-kuma"
+	HP_Generic      HeartbeatPreset = "generic"
+
+	HE_Start   HeartbeatEvent = "start"
+	HE_Success HeartbeatEvent = "success"
+	HE_Fail    HeartbeatEvent = "fail"
+
+	// How much of the log is sent along with the success and fail pings
+	heartbeatLogTail = 10 * 1024
+	// Uptime Kuma only shows a short message
+	heartbeatKumaMessage = 200
+)
+
+// HeartbeatSettings pings an external monitor when a run or a job starts and finishes,
+// so that the monitor can raise an alert when a backup never starts.
+type HeartbeatSettings struct {
+	// Empty to disable the heartbeat
+	URL    string
+	Preset HeartbeatPreset
+}
+
+func (h HeartbeatSettings) isEnabled() bool {
+	return h.URL != ""
+}
+
+func (h HeartbeatSettings) validate() error {
+	if !h.isEnabled() {
+		return nil
+	}
+	switch h.Preset {
+	case HP_Healthchecks, HP_UptimeKuma, HP_Generic:
+	case "":
+		// A generic ping to a healthchecks.io URL would always count as a success
+		return errors.New("heartbeat has no Preset")
+	default:
+		return fmt.Errorf("invalid heartbeat preset: %v", string(h.Preset))
+	}
+	if _, err := url.Parse(h.URL); err != nil {
+		return fmt.Errorf("invalid heartbeat URL: %w", err)
+	}
+	return nil
+}
+
+// logTail keeps the last size bytes of a log, i.e. of the current run, starting on a full line.
+type logTail struct {
+	mutex sync.Mutex
+	buf   []byte
+	size  int
+}
+
+func (t *logTail) Write(p []byte) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.size {
+		t.buf = t.buf[len(t.buf)-t.size:]
+		// Start on a full line
+		if i := bytes.IndexByte(t.buf, '\n'); i >= 0 {
+			t.buf = t.buf[i+1:]
+		}
+		t.buf = append([]byte{}, t.buf...)
+	}
+	return len(p), nil
+}
+
+func (t *logTail) String() string {
+	if t == nil {
+		return ""
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return string(t.buf)
+}
+
+// lastLine returns the message and error of the last log record, in either log format.
+func (t *logTail) lastLine() string {
+	lines := strings.Split(strings.TrimSpace(t.String()), "\n")
+	line := lines[len(lines)-1]
+
+	var record struct {
+		Msg   string `json:"msg"`
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(line), &record); err != nil || record.Msg == "" {
+		var ok bool
+		if record.Msg, ok = textLogValue(line, "msg"); !ok {
+			return line
+		}
+		record.Error, _ = textLogValue(line, "error")
+	}
+	if record.Error != "" {
+		return record.Msg + ": " + record.Error
+	}
+	return record.Msg
+}
+
+// textLogValue reads an attribute of a record of the text log format.
+func textLogValue(line string, key string) (string, bool) {
+	_, value, ok := strings.Cut(line, " "+key+"=")
+	if !ok {
+		return "", false
+	}
+	if quoted, err := strconv.QuotedPrefix(value); err == nil {
+		value, _ = strconv.Unquote(quoted)
+		return value, true
+	}
+	value, _, _ = strings.Cut(value, " ")
+	return value, true
+}
+
+// newRunID returns a random UUID, the format healthchecks.io wants for its run IDs.
+func newRunID() string {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16])
+}
+
+// heartbeat sends the pings of a run, or of a job of the run.
+type heartbeat struct {
+	settings HeartbeatSettings
+	jobName  string
+	runID    string
+	log      *logTail
+}
+
+func (h heartbeat) request(event HeartbeatEvent) (*http.Request, error) {
+	switch h.settings.Preset {
+	case HP_Healthchecks:
+		// https://healthchecks.io/docs/http_api/
+		target := strings.TrimSuffix(h.settings.URL, "/")
+		if event != HE_Success {
+			target += "/" + string(event)
+		}
+		target += "?rid=" + url.QueryEscape(h.runID)
+
+		body := ""
+		if event != HE_Start {
+			body = h.log.String()
+		}
+		return http.NewRequest("POST", target, strings.NewReader(body))
+
+	case HP_UptimeKuma:
+		// Push monitors have no start event, and take their status in the query string
+		target, err := url.Parse(h.settings.URL)
+		if err != nil {
+			return nil, err
+		}
+		status := "up"
+		if event == HE_Fail {
+			status = "down"
+		}
+		message := fmt.Sprintf("%v (run %v): %v", string(event), h.runID, h.log.lastLine())
+		target.RawQuery = url.Values{
+			"status": {status},
+			"msg":    {truncate(message, heartbeatKumaMessage)},
+			"ping":   {""},
+		}.Encode()
+		return http.NewRequest("GET", target.String(), nil)
+
+	default:
+		hostname, _ := os.Hostname()
+		body, err := json.Marshal(map[string]string{
+			"run_id":          h.runID,
+			"event":           string(event),
+			"job":             h.jobName,
+			"host":            hostname,
+			"time":            time.Now().UTC().Format(time.RFC3339),
+			"borgmox_version": BorgmoxVersion,
+			"log":             h.log.String(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest("POST", h.settings.URL, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	}
+}
+
+// ping sends an event to the monitor. A failed ping is logged, it never fails a job.
+func (h heartbeat) ping(event HeartbeatEvent) {
+	if !h.settings.isEnabled() {
+		return
+	}
+	if h.settings.Preset == HP_UptimeKuma && event == HE_Start {
+		return
+	}
+
+	err := retry(func() error {
+		req, err := h.request(event)
+		if err != nil {
+			return &permanentError{err}
+		}
+		req.Header.Set("User-Agent", "borgmox/"+BorgmoxVersion)
+
+		res, err := notifyHttpClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		return checkHttpResponse("heartbeat", res)
+	})
+	if err != nil {
+		jobLogger(h.jobName, "").Error("Cannot send the heartbeat", "event", string(event), "error", err)
+	}
+}
+
+// finish sends the success or fail ping.
+func (h heartbeat) finish(failed bool) {
+	if failed {
+		h.ping(HE_Fail)
+	} else {
+		h.ping(HE_Success)
+	}
+}
+
+func (s *JobData) heartbeat(jobName string, settings HeartbeatSettings) heartbeat {
+	return heartbeat{
+		settings: settings,
+		jobName:  jobName,
+		runID:    s.runID,
+		log:      s.logTail,
+	}
+}
+
+// IsFailed reports whether anything went wrong in the job, including replicas.
+// Undelivered notifications don't count, they are retried on the next run.
+func (r JobResult) IsFailed() bool {
+	return r.Error != nil ||
+		len(r.FailedBackups) > 0 ||
+		len(r.FailedReplicaBackups) > 0 ||
+		len(r.FailedPrunes) > 0 ||
+		len(orphanErrors(r.Orphans)) > 0 ||
+		r.FailedCompact != nil ||
+		r.FailedCheck != nil ||
+		len(r.FailedAudit) > 0
+}
@@ -0,0 +1,89 @@
+package Job
+
+import (
+	"borgmox/BorgCLI"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+func (s *JobData) InitRepository(jobName string, options InitRepoOptions) error {
+	jobSettings, ok := s.BackupJobs[jobName]
+	if !ok {
+		return fmt.Errorf("backup job %v does not exist", jobName)
+	}
+
+	repository := jobSettings.Borg
+	if options.Repository != "" {
+		found := false
+		for _, r := range jobSettings.repositories() {
+			if r.Repository == options.Repository {
+				repository = r
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("backup job %v has no repository or replica %v", jobName, options.Repository)
+		}
+	}
+
+	if repository.Repository == "" {
+		return fmt.Errorf("backup job %v has no borg repository", jobName)
+	}
+
+	if options.Encryption.HasKey() && repository.Passphrase == "" {
+		return fmt.Errorf("backup job %v has no passphrase, refusing to create an encrypted repository", jobName)
+	}
+
+	if options.KeyExportPath != "" {
+		if !options.Encryption.HasKey() {
+			return fmt.Errorf("encryption mode %v has no key to export", string(options.Encryption))
+		}
+		if _, err := os.Stat(options.KeyExportPath); err == nil {
+			return fmt.Errorf("key export path %v already exists, refusing to overwrite it", options.KeyExportPath)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("cannot verify key export path %v: %w", options.KeyExportPath, err)
+		}
+	}
+
+	if exists, err := BorgCLI.RepositoryExists(repository); err != nil {
+		return fmt.Errorf("cannot verify whether repository %v exists: %w", repository.Repository, err)
+	} else if exists {
+		return fmt.Errorf("repository %v already exists, refusing to initialize it", repository.Repository)
+	}
+
+	var cmdRunAll *exec.Cmd
+	var err error
+
+	if cmdRunAll, err = BorgCLI.InitRepository(repository, BorgCLI.InitRepositorySettings{
+		Encryption: options.Encryption,
+	}); err != nil {
+		return err
+	}
+
+	logger := jobLogger(jobName, "").With("repository", repository.Repository)
+	logger.Info("Now initializing borg repository", "encryption", string(options.Encryption))
+	if err := s.runBorg(logger, cmdRunAll); errors.Is(err, BorgCLI.ErrRepositoryAlreadyExists) {
+		// Created since RepositoryExists looked
+		return fmt.Errorf("repository %v already exists, refusing to initialize it: %w", repository.Repository, err)
+	} else if err != nil {
+		return fmt.Errorf("cannot initialize repository %v: %w", repository.Repository, err)
+	}
+
+	if options.KeyExportPath == "" {
+		return nil
+	}
+
+	if cmdRunAll, err = BorgCLI.ExportKey(repository, options.KeyExportPath, options.PaperKey); err != nil {
+		return err
+	}
+
+	logger.Info("Now exporting the repository key", "path", options.KeyExportPath)
+	if err := s.runBorg(logger, cmdRunAll); err != nil {
+		return fmt.Errorf("repository %v was created, but its key couldn't be exported: %w", repository.Repository, err)
+	}
+
+	return nil
+}
@@ -1,13 +1,33 @@
 package Job
 
-import (
-	"encoding/base64"
-	"net/http"
-	"strings"
-)
+import "time"
+
+// BorgmoxVersion is set at build time with -ldflags "-X borgmox/Job.BorgmoxVersion=..."
+var BorgmoxVersion = "dev"
 
 type JobData struct {
+	StateDirectory string
+	// Pings for the whole run, see BackupJobSettings.Heartbeat for single jobs
+	Heartbeat HeartbeatSettings
+	// A single notification summing up all the jobs of the run
+	Digest DigestSettings
+	// The log of every VM/LXC backup, in a directory per run
+	GuestLogs GuestLogSettings
+	// Where the JSON report of every run is written, empty to disable; --report-file takes precedence
+	ReportFile string
 	BackupJobs map[string]BackupJobSettings
+
+	runID      string
+	runStarted time.Time
+	logTail    *logTail
+	// Where the logs of the VMs/LXCs of the current run go, inside the GuestLogs directory
+	guestLogRunDirectory string
+	// Notifiers that failed during the run, by NotifierBackend.key: their next notifications are spooled right away
+	failedNotifiers map[string]error
+	// Notifications of the run that belong to no job and couldn't be delivered, i.e. the digest
+	failedNotifications []error
+	// Results of the compactions of the run, by repository, for the run report
+	compactResults map[string]error
 }
 
 func highestPriority(a, b NotificationPriority) NotificationPriority {
@@ -27,69 +47,3 @@ func highestPriority(a, b NotificationPriority) NotificationPriority {
 	}
 	return NP_Disabled
 }
-
-func (s *JobData) sendSuccessNotification(jobSettings BackupJobSettings, notificationTargetInfo NotificationTargetInfo, title string, message string, tags []string) error {
-	if notificationTargetInfo.SuccessPriority == NP_Disabled || jobSettings.Notification.TargetServer == "" {
-		return nil
-	}
-
-	if req, err := http.NewRequest("POST", jobSettings.Notification.TargetServer+"/"+jobSettings.Notification.Topic,
-		strings.NewReader(message)); err != nil {
-		return err
-	} else {
-		if jobSettings.Notification.AuthUser != "" {
-			req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(jobSettings.Notification.AuthUser+":"+jobSettings.Notification.AuthPassword)))
-		} else if jobSettings.Notification.AuthPassword != "" {
-			req.Header.Set("Authorization", "Bearer "+jobSettings.Notification.AuthPassword)
-		}
-
-		req.Header.Set("Title", title)
-		req.Header.Set("Priority", string(notificationTargetInfo.SuccessPriority))
-		req.Header.Set("Tags", strings.Join(tags, ","))
-
-		if notificationTargetInfo.SuccessEmailTarget != "" {
-			req.Header.Set("Email", notificationTargetInfo.SuccessEmailTarget)
-		}
-
-		if res, err := http.DefaultClient.Do(req); err != nil {
-			return err
-		} else {
-			defer res.Body.Close()
-			// Post-process res?
-			return nil
-		}
-	}
-}
-
-func (s *JobData) sendFailureNotification(jobSettings BackupJobSettings, notificationTargetInfo NotificationTargetInfo, title string, message string, tags []string) error {
-	if notificationTargetInfo.FailurePriority == NP_Disabled || jobSettings.Notification.TargetServer == "" {
-		return nil
-	}
-
-	if req, err := http.NewRequest("POST", jobSettings.Notification.TargetServer+"/"+jobSettings.Notification.Topic,
-		strings.NewReader(message)); err != nil {
-		return err
-	} else {
-		if jobSettings.Notification.AuthUser != "" {
-			req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(jobSettings.Notification.AuthUser+":"+jobSettings.Notification.AuthPassword)))
-		} else if jobSettings.Notification.AuthPassword != "" {
-			req.Header.Set("Authorization", "Bearer "+jobSettings.Notification.AuthPassword)
-		}
-
-		req.Header.Set("Title", title)
-		req.Header.Set("Priority", string(notificationTargetInfo.FailurePriority))
-		req.Header.Set("Tags", strings.Join(tags, ","))
-
-		if notificationTargetInfo.FailureEmailTarget != "" {
-			req.Header.Set("Email", notificationTargetInfo.FailureEmailTarget)
-		}
-
-		if res, err := http.DefaultClient.Do(req); err != nil {
-			return err
-		} else {
-			defer res.Body.Close()
-			// Post-process res?
-			return nil
-		}
-	}
-}
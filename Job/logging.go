@@ -0,0 +1,187 @@
+package Job
+
+import (
+	"borgmox/BorgCLI"
+	"borgmox/ProxmoxCLI"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+type LogFormat string
+
+const (
+	LF_Text LogFormat = "text"
+	LF_JSON LogFormat = "json"
+)
+
+// logSink is where the log records are written, a copy can be kept for the heartbeats.
+type logSink struct {
+	mutex sync.Mutex
+	out   io.Writer
+	tail  io.Writer
+}
+
+func (l *logSink) Write(p []byte) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.tail != nil {
+		l.tail.Write(p)
+	}
+	return l.out.Write(p)
+}
+
+// capture copies the log records to tail until release is called.
+func (l *logSink) capture(tail io.Writer) (release func()) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	previous := l.tail
+	l.tail = tail
+	return func() {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		l.tail = previous
+	}
+}
+
+var logOutput = &logSink{out: os.Stderr}
+
+func init() {
+	slog.SetDefault(slog.New(slog.NewTextHandler(logOutput, nil)))
+}
+
+// SetupLogging makes every log record go to stderr, in the given format, starting at the given level.
+func SetupLogging(format LogFormat, level string) error {
+	var minLevel slog.Level
+	if err := minLevel.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level %v: %w", level, err)
+	}
+	options := &slog.HandlerOptions{Level: minLevel}
+
+	switch format {
+	case LF_Text:
+		slog.SetDefault(slog.New(slog.NewTextHandler(logOutput, options)))
+	case LF_JSON:
+		slog.SetDefault(slog.New(slog.NewJSONHandler(logOutput, options)))
+	default:
+		return fmt.Errorf("invalid log format: %v", string(format))
+	}
+	return nil
+}
+
+// jobLogger returns the logger of a Backup Job, during one of its phases.
+func jobLogger(jobName string, phase NotificationPhase) *slog.Logger {
+	logger := slog.Default()
+	if jobName != "" {
+		logger = logger.With("job", jobName)
+	}
+	if phase != "" {
+		logger = logger.With("phase", string(phase))
+	}
+	return logger
+}
+
+// guestLogger returns the logger of a VM/LXC of a Backup Job, during one of its phases.
+func guestLogger(jobName string, phase NotificationPhase, info ProxmoxCLI.MachineInfo) *slog.Logger {
+	return jobLogger(jobName, phase).With("vmid", info.VMID, "name", info.Name, "type", machineTypeName(info.Type))
+}
+
+// logWriter re-emits the output of a child process as log records, one per line.
+// Lines that are overwritten with a carriage return are dropped.
+type logWriter struct {
+	mutex    sync.Mutex
+	logger   *slog.Logger
+	line     []byte
+	overtype bool
+}
+
+func newLogWriter(logger *slog.Logger, source string) *logWriter {
+	return &logWriter{
+		logger: logger.With("source", source),
+	}
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for _, c := range p {
+		switch c {
+		case '\n':
+			w.emit()
+		case '\r':
+			w.overtype = true
+		default:
+			if w.overtype {
+				w.line = w.line[:0]
+				w.overtype = false
+			}
+			w.line = append(w.line, c)
+		}
+	}
+	return len(p), nil
+}
+
+// Close emits the last line, if it has no line break.
+func (w *logWriter) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.emit()
+	return nil
+}
+
+func (w *logWriter) emit() {
+	line := string(bytes.TrimSpace(w.line))
+	w.line = w.line[:0]
+	w.overtype = false
+	if line == "" {
+		return
+	}
+
+	// vzdump and BorgCLI.LogCollector prefix the lines with their level
+	level := slog.LevelInfo
+	if rest, ok := strings.CutPrefix(line, "ERROR: "); ok {
+		level, line = slog.LevelError, rest
+	} else if rest, ok := strings.CutPrefix(line, "WARN: "); ok {
+		level, line = slog.LevelWarn, rest
+	} else if rest, ok := strings.CutPrefix(line, "WARNING: "); ok {
+		level, line = slog.LevelWarn, rest
+	} else if rest, ok := strings.CutPrefix(line, "INFO: "); ok {
+		line = rest
+	}
+	w.logger.Log(context.Background(), level, line)
+}
+
+// runBorg runs a borg process, and logs its output line by line.
+// When it fails, the error wraps a *BorgCLI.Error, followed by the last lines of output.
+func (s *JobData) runBorg(logger *slog.Logger, cmd *exec.Cmd) error {
+	_, err := s.runBorgOutput(logger, cmd)
+	return err
+}
+
+// runBorgOutput is runBorg, also returning what borg printed besides its errors, i.e. the archive list of "borg prune --list".
+func (s *JobData) runBorgOutput(logger *slog.Logger, cmd *exec.Cmd) (string, error) {
+	log := newLogWriter(logger, "borg")
+	defer log.Close()
+
+	var output bytes.Buffer
+	tail := newTailBuffer(io.MultiWriter(log, &output), s.GuestLogs.errorLines())
+	borgLog := BorgCLI.NewLogCollector(tail)
+	cmd.Stdout = tail
+	cmd.Stderr = borgLog
+	err := cmd.Run()
+	borgLog.Close()
+	if err := borgLog.Err(err); err != nil {
+		return output.String(), tail.wrap(err)
+	}
+	return output.String(), nil
+}
@@ -0,0 +1,403 @@
+package Job
+
+import (
+	"borgmox/BorgCLI"
+	"borgmox/ProxmoxCLI"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type NotifierType string
+type NotificationPhase string
+type NotificationOutcome string
+
+const (
+	NT_Ntfy    NotifierType = "ntfy"
+	NT_Smtp    NotifierType = "smtp"
+	NT_Webhook NotifierType = "webhook"
+	NT_Pve     NotifierType = "pve"
+
+	NPH_Backup     NotificationPhase = "backup"
+	NPH_Prune      NotificationPhase = "prune"
+	NPH_PruneGuard NotificationPhase = "prune guard"
+	NPH_Orphans    NotificationPhase = "orphans"
+	NPH_Compact    NotificationPhase = "compact"
+	NPH_Check      NotificationPhase = "check"
+	NPH_Audit      NotificationPhase = "audit"
+	NPH_Digest     NotificationPhase = "digest"
+
+	NO_Success NotificationOutcome = "success"
+	NO_Partial NotificationOutcome = "partial"
+	NO_Failure NotificationOutcome = "failure"
+
+	notifyTimeout = 30 * time.Second
+	// A notification is sent up to notifyAttempts times, waiting notifyBackoff, then twice as long, and so on
+	notifyAttempts = 3
+	notifyBackoff  = 2 * time.Second
+)
+
+var notifyHttpClient = &http.Client{Timeout: notifyTimeout}
+
+// NotificationEvent describes something that happened during a job, independently of how it's delivered.
+type NotificationEvent struct {
+	Job     string
+	Phase   NotificationPhase
+	Outcome NotificationOutcome
+	// Frequency is NF_EveryVmFinished for single VM/LXC events, NF_EntireJobFinished for job summaries,
+	// and empty for events that are sent whenever notifications are enabled.
+	Frequency NotificationFrequency
+
+	// The VMs/LXCs of the job, to name them
+	Machines map[uint64]ProxmoxCLI.MachineInfo
+
+	// Single VM/LXC events
+	VMID        uint64
+	MachineType ProxmoxCLI.MachineType
+	Stats       *StreamStats
+
+	Repository string
+	Error      error
+	// The vzdump/borg output of the failed VMs/LXCs
+	Log string
+
+	// Job summaries
+	Succeeded      []uint64
+	Failed         map[uint64]error
+	FailedReplicas map[uint64]error
+	BackupStats    map[uint64]StreamStats
+	Orphans        []OrphanResult
+	Compact        bool
+	// The prune overrides referring to VMIDs that aren't part of the job anymore
+	StaleOverrides error
+
+	Check BorgCLI.CheckResult
+
+	// The digest of a whole run, sent with an empty Job
+	Digest *RunDigest
+}
+
+// label names what the event is about, its job or the whole run.
+func (e NotificationEvent) label() string {
+	if e.Job == "" {
+		return "Borgmox run"
+	}
+	return "Backup Job " + e.Job
+}
+
+// logger returns the logger of the job, phase and VM/LXC of the event.
+func (e NotificationEvent) logger() *slog.Logger {
+	logger := jobLogger(e.Job, e.Phase)
+	if e.VMID != 0 {
+		logger = logger.With("vmid", e.VMID)
+	}
+	return logger
+}
+
+// Notification is an event routed to a notifier, with what it should say and how loudly.
+type Notification struct {
+	// ID stays the same across the delivery attempts, even from the spool, so that receivers can deduplicate them
+	ID    string
+	Event NotificationEvent
+	// Where the event was routed, for the notifier specific options
+	Target   NotificationTargetInfo
+	Title    string
+	Message  string
+	Priority NotificationPriority
+	Email    string
+}
+
+type Notifier interface {
+	Send(notification Notification) error
+}
+
+func newNotifier(backend NotifierBackend) (Notifier, error) {
+	switch backend.Type {
+	case NT_Ntfy, NT_Smtp, NT_Webhook, NT_Pve:
+	default:
+		return nil, fmt.Errorf("unknown notifier type: %v", string(backend.Type))
+	}
+	if err := backend.checkTables(); err != nil {
+		return nil, err
+	}
+
+	switch backend.Type {
+	case NT_Ntfy:
+		return &ntfyNotifier{settings: *backend.Ntfy}, nil
+	case NT_Smtp:
+		return newSmtpNotifier(*backend.Smtp)
+	case NT_Webhook:
+		return newWebhookNotifier(*backend.Webhook)
+	default:
+		return &pveNotifier{}, nil
+	}
+}
+
+// checkTables makes sure that a notifier has the settings table of its Type, and none of the others.
+func (b NotifierBackend) checkTables() error {
+	tables := []struct {
+		notifierType NotifierType
+		name         string
+		set          bool
+	}{
+		{NT_Ntfy, "Ntfy", b.Ntfy != nil},
+		{NT_Smtp, "Smtp", b.Smtp != nil},
+		{NT_Webhook, "Webhook", b.Webhook != nil},
+	}
+	for _, table := range tables {
+		if table.set && table.notifierType != b.Type {
+			return fmt.Errorf("%v notifier can't have a %v table, it's only read by %v notifiers", string(b.Type), table.name, string(table.notifierType))
+		} else if !table.set && table.notifierType == b.Type {
+			return fmt.Errorf("%v notifier has no %v table", string(b.Type), table.name)
+		}
+	}
+	return nil
+}
+
+// notifiers returns all the notifiers of the job, including the ntfy settings of the "Notification" group.
+func (js BackupJobSettings) notifiers() []NotifierSettings {
+	notifiers := []NotifierSettings{}
+	if js.Notification.TargetServer != "" {
+		ntfy := js.Notification.NtfySettings
+		notifiers = append(notifiers, NotifierSettings{
+			NotifierBackend: NotifierBackend{
+				Type:                  NT_Ntfy,
+				NotificationTemplates: js.Notification.NotificationTemplates,
+				Ntfy:                  &ntfy,
+			},
+			NotificationTargets: js.Notification.NotificationTargets,
+		})
+	}
+	return append(notifiers, js.Notifications...)
+}
+
+func (n NotificationTargets) target(phase NotificationPhase) NotificationTargetInfo {
+	switch phase {
+	case NPH_Backup:
+		return n.BackupTargetInfo
+	case NPH_Check, NPH_Audit:
+		return n.CheckTargetInfo
+	default:
+		return n.PruneTargetInfo
+	}
+}
+
+func (n NotificationTargetInfo) accepts(frequency NotificationFrequency) bool {
+	if frequency == "" {
+		return n.isEnabled()
+	}
+	return n.Frequency == frequency
+}
+
+func (n NotificationTargetInfo) priority(event NotificationEvent) NotificationPriority {
+	switch event.Outcome {
+	case NO_Success:
+		return n.SuccessPriority
+	case NO_Partial:
+		return highestPriority(n.FailurePriority, n.SuccessPriority)
+	default:
+		if event.Phase == NPH_PruneGuard {
+			return highestPriority(n.FailurePriority, NP_High)
+		}
+		return n.FailurePriority
+	}
+}
+
+func (n NotificationTargetInfo) email(event NotificationEvent) string {
+	if event.Outcome == NO_Success {
+		return n.SuccessEmailTarget
+	}
+	return n.FailureEmailTarget
+}
+
+// notify delivers an event to every notifier of the job that wants it.
+// A notification never fails a job: delivery errors are logged and recorded in the result,
+// and the notification is spooled to be sent again on the next run.
+func (s *JobData) notify(js BackupJobSettings, event NotificationEvent, result *JobResult) {
+	for _, settings := range js.notifiers() {
+		if err := s.notifyOne(settings.NotifierBackend, settings.target(event.Phase), event); err != nil {
+			result.FailedNotifications = append(result.FailedNotifications, err)
+		}
+	}
+}
+
+// notifyRun delivers an event of the whole run, that belongs to no job: to the Digest notifiers when the digest
+// is enabled, or else once to every notifier of the jobs, routed by their own targets.
+// Delivery errors are added to FailedNotifications.
+func (s *JobData) notifyRun(jobNames []string, event NotificationEvent) {
+	if s.Digest.isEnabled() && len(s.Digest.Notifications) > 0 {
+		for _, settings := range s.Digest.Notifications {
+			if err := s.notifyOne(settings, s.Digest.NotificationTargetInfo, event); err != nil {
+				s.failedNotifications = append(s.failedNotifications, err)
+			}
+		}
+		return
+	}
+
+	notified := map[string]struct{}{}
+	for _, jobName := range jobNames {
+		for _, settings := range s.BackupJobs[jobName].notifiers() {
+			if _, ok := notified[settings.key()]; ok {
+				continue
+			}
+			notified[settings.key()] = struct{}{}
+			if err := s.notifyOne(settings.NotifierBackend, settings.target(event.Phase), event); err != nil {
+				s.failedNotifications = append(s.failedNotifications, err)
+			}
+		}
+	}
+}
+
+// notifyOne delivers an event to a single notifier, if its target wants it.
+func (s *JobData) notifyOne(settings NotifierBackend, target NotificationTargetInfo, event NotificationEvent) error {
+	if !target.accepts(event.Frequency) {
+		return nil
+	}
+	priority := target.priority(event)
+	if priority == NP_Disabled {
+		return nil
+	}
+
+	notifier, err := newNotifier(settings)
+	if err != nil {
+		event.logger().Error("Cannot send the notification", "error", err)
+		return fmt.Errorf("%v notification: %w", string(event.Phase), err)
+	}
+
+	title, message, err := settings.render(event, priority, settings.Type == NT_Ntfy && target.Markdown)
+	if err != nil {
+		event.logger().Warn("Cannot render the notification, using the default text", "error", err)
+	}
+	notification := Notification{
+		ID:       newNotificationID(),
+		Event:    event,
+		Target:   target,
+		Title:    title,
+		Message:  message,
+		Priority: priority,
+		Email:    target.email(event),
+	}
+	if err, ok := s.failedNotifiers[settings.key()]; ok {
+		// Don't wait for it again, it will most likely fail the same way
+		event.logger().Warn("Spooling the notification, the notifier failed earlier in the run", "notifier", string(settings.Type), "error", err)
+		if err := s.spool(settings, notification); err != nil {
+			event.logger().Error("Cannot spool the notification", "notifier", string(settings.Type), "error", err)
+		}
+		return fmt.Errorf("%v notification through %v: %w", string(event.Phase), string(settings.Type), err)
+	}
+
+	if err := deliver(notifier, notification); err != nil {
+		event.logger().Error("Cannot send the notification", "notifier", string(settings.Type), "error", err)
+
+		if !isPermanent(err) {
+			s.notifierFailed(settings, err)
+			if err := s.spool(settings, notification); err != nil {
+				event.logger().Error("Cannot spool the notification", "notifier", string(settings.Type), "error", err)
+			}
+		}
+		return fmt.Errorf("%v notification through %v: %w", string(event.Phase), string(settings.Type), err)
+	}
+	return nil
+}
+
+// newNotificationID returns an ID that no other notification of this host has.
+func newNotificationID() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 10)
+}
+
+// key identifies a notifier by where it delivers, the same for every job that uses it.
+func (b NotifierBackend) key() string {
+	data, _ := json.Marshal(struct {
+		Type    NotifierType
+		Ntfy    *NtfySettings
+		Smtp    *SmtpSettings
+		Webhook *WebhookSettings
+	}{b.Type, b.Ntfy, b.Smtp, b.Webhook})
+	return string(data)
+}
+
+// notifierFailed remembers that a notifier couldn't deliver, for the rest of the run.
+func (s *JobData) notifierFailed(settings NotifierBackend, err error) {
+	if s.failedNotifiers == nil {
+		s.failedNotifiers = map[string]error{}
+	}
+	s.failedNotifiers[settings.key()] = err
+}
+
+// FailedNotifications returns the notifications of the run that belong to no job, and couldn't be delivered.
+func (s *JobData) FailedNotifications() []error {
+	return s.failedNotifications
+}
+
+// permanentError is a delivery error that sending again can't fix, i.e. a rejected request.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+func isPermanent(err error) bool {
+	var permanent *permanentError
+	return errors.As(err, &permanent)
+}
+
+// retry runs send until it succeeds, fails permanently, or runs out of attempts, with an increasing delay.
+func retry(send func() error) error {
+	backoff := notifyBackoff
+	for attempt := 1; ; attempt++ {
+		err := send()
+		if err == nil || attempt >= notifyAttempts || isPermanent(err) {
+			return err
+		}
+		slog.Warn("Delivery attempt failed, retrying", "attempt", attempt, "attempts", notifyAttempts, "backoff", backoff, "error", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func deliver(notifier Notifier, notification Notification) error {
+	return retry(func() error {
+		return notifier.Send(notification)
+	})
+}
+
+// checkHttpResponse turns a non-2xx response into an error. Client errors are permanent,
+// except for timeouts and rate limits.
+func checkHttpResponse(service string, res *http.Response) error {
+	if res.StatusCode >= 200 && res.StatusCode <= 299 {
+		return nil
+	}
+
+	err := fmt.Errorf("%v returned %v", service, res.Status)
+	if body, _ := io.ReadAll(io.LimitReader(res.Body, 512)); len(strings.TrimSpace(string(body))) > 0 {
+		err = fmt.Errorf("%w: %v", err, strings.TrimSpace(string(body)))
+	}
+	if res.StatusCode >= 400 && res.StatusCode <= 499 && res.StatusCode != http.StatusRequestTimeout && res.StatusCode != http.StatusTooManyRequests {
+		return &permanentError{err}
+	}
+	return err
+}
+
+func sortedVMIDs(m map[uint64]struct{}) []uint64 {
+	keys := make([]uint64, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i] < keys[j]
+	})
+	return keys
+}
@@ -0,0 +1,125 @@
+package Job
+
+import (
+	"encoding/base64"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type ntfyNotifier struct {
+	settings NtfySettings
+}
+
+// ntfyHeader makes a value safe for an HTTP header, ntfy decodes RFC 2047 encoded words.
+func ntfyHeader(value string) string {
+	value = strings.Join(strings.Fields(strings.ReplaceAll(value, "\n", " ")), " ")
+	return mime.BEncoding.Encode("UTF-8", value)
+}
+
+// ntfyTags returns the tags of a notification: an emoji for the outcome, the phase and the job, then the configured ones.
+// ntfy shows the tags that match an emoji short code as emojis.
+func ntfyTags(event NotificationEvent, target NotificationTargetInfo) string {
+	tags := []string{}
+	switch event.Outcome {
+	case NO_Success:
+		tags = append(tags, "white_check_mark")
+	case NO_Partial:
+		tags = append(tags, "warning")
+	default:
+		tags = append(tags, "rotating_light")
+	}
+	tags = append(tags, string(event.Phase))
+	if event.Job != "" {
+		tags = append(tags, event.Job)
+	}
+	tags = append(tags, target.Tags...)
+
+	for i, tag := range tags {
+		tags[i] = strings.ReplaceAll(tag, ",", " ")
+	}
+	return ntfyHeader(strings.Join(tags, ","))
+}
+
+// ntfyFilename names the log attachment after the job, and the VM/LXC when there's one.
+func ntfyFilename(event NotificationEvent) string {
+	name := "borgmox"
+	if event.Job != "" {
+		name += "-" + archiveField(event.Job)
+	}
+	if event.VMID != 0 {
+		name += "-" + strconv.FormatUint(event.VMID, 10)
+	} else {
+		name += "-" + archiveField(string(event.Phase))
+	}
+	return name + ".log"
+}
+
+func (n *ntfyNotifier) Send(notification Notification) error {
+	if n.settings.TargetServer == "" {
+		return nil
+	}
+
+	target := notification.Target
+	if target.AttachLog && notification.Event.Outcome != NO_Success && notification.Event.Log != "" {
+		err := n.send(notification, target, true)
+		if err == nil || !isPermanent(err) {
+			return err
+		}
+		// i.e. the server has no attachment cache
+		notification.Event.logger().Warn("ntfy refused the log attachment, sending the notification without it", "error", err)
+	}
+	return n.send(notification, target, false)
+}
+
+func (n *ntfyNotifier) send(notification Notification, target NotificationTargetInfo, attachLog bool) error {
+	var body io.Reader = strings.NewReader(notification.Message)
+	method := "POST"
+	if attachLog {
+		// The body is the attachment, and the message moves to a header
+		body = strings.NewReader(notification.Event.Log)
+		method = "PUT"
+	}
+
+	if req, err := http.NewRequest(method, n.settings.TargetServer+"/"+n.settings.Topic, body); err != nil {
+		return err
+	} else {
+		if n.settings.AuthUser != "" {
+			req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(n.settings.AuthUser+":"+n.settings.AuthPassword)))
+		} else if n.settings.AuthPassword != "" {
+			req.Header.Set("Authorization", "Bearer "+n.settings.AuthPassword)
+		}
+
+		req.Header.Set("Title", ntfyHeader(notification.Title))
+		req.Header.Set("Priority", string(notification.Priority))
+		req.Header.Set("Tags", ntfyTags(notification.Event, target))
+
+		if target.Markdown {
+			req.Header.Set("Markdown", "yes")
+		}
+		if target.Click != "" {
+			req.Header.Set("Click", target.Click)
+		}
+		if target.Actions != "" {
+			req.Header.Set("Actions", ntfyHeader(target.Actions))
+		}
+		if attachLog {
+			// ntfy turns "\n" back into new lines
+			req.Header.Set("Message", mime.BEncoding.Encode("UTF-8", strings.ReplaceAll(notification.Message, "\n", `\n`)))
+			req.Header.Set("Filename", ntfyFilename(notification.Event))
+		}
+
+		if notification.Email != "" {
+			req.Header.Set("Email", notification.Email)
+		}
+
+		if res, err := notifyHttpClient.Do(req); err != nil {
+			return err
+		} else {
+			defer res.Body.Close()
+			return checkHttpResponse("ntfy", res)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package Job
+
+import (
+	"borgmox/ProxmoxCLI"
+	"strconv"
+)
+
+// pveNotifierType is the "type" field of the notifications, i.e. "match-field exact:type=borgmox".
+const pveNotifierType = "borgmox"
+
+// pveNotifier sends the notifications through the targets and matchers configured in PVE.
+type pveNotifier struct{}
+
+func pveSeverity(event NotificationEvent) ProxmoxCLI.NotifySeverity {
+	switch event.Outcome {
+	case NO_Success:
+		if event.Phase == NPH_Orphans {
+			return ProxmoxCLI.NotifyNotice
+		}
+		return ProxmoxCLI.NotifyInfo
+	case NO_Partial:
+		return ProxmoxCLI.NotifyWarning
+	default:
+		return ProxmoxCLI.NotifyError
+	}
+}
+
+func pveFields(notification Notification) map[string]string {
+	event := notification.Event
+	fields := map[string]string{
+		"type":     pveNotifierType,
+		"job-id":   event.Job,
+		"phase":    string(event.Phase),
+		"outcome":  string(event.Outcome),
+		"priority": string(notification.Priority),
+	}
+	if event.VMID != 0 {
+		fields["vmid"] = strconv.FormatUint(event.VMID, 10)
+	}
+	if event.Repository != "" {
+		fields["repository"] = event.Repository
+	}
+	return fields
+}
+
+func (n *pveNotifier) Send(notification Notification) error {
+	return ProxmoxCLI.SendNotification(pveSeverity(notification.Event), notification.Title, notification.Message, pveFields(notification))
+}
@@ -0,0 +1,347 @@
+package Job
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"html"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type SmtpSecurity string
+
+const (
+	SS_StartTLS SmtpSecurity = "starttls"
+	SS_TLS      SmtpSecurity = "tls"
+	SS_None     SmtpSecurity = "none"
+)
+
+type SmtpSettings struct {
+	// host or host:port, empty to only use sendmail
+	Server   string
+	Security SmtpSecurity
+	User     string
+	Password string
+	From     string
+	To       []string
+	// Path to a sendmail binary, used when Server is empty or can't deliver the mail
+	Sendmail string
+}
+
+type smtpNotifier struct {
+	settings SmtpSettings
+	// Opens the connection to the server, replaced by the tests
+	dial func(address string, tlsConfig *tls.Config) (net.Conn, error)
+}
+
+func newSmtpNotifier(settings SmtpSettings) (*smtpNotifier, error) {
+	switch settings.Security {
+	case "", SS_StartTLS, SS_TLS, SS_None:
+	default:
+		return nil, fmt.Errorf("invalid smtp security: %v", string(settings.Security))
+	}
+	if settings.From == "" {
+		return nil, errors.New("smtp notifier has no From address")
+	}
+	if len(settings.To) == 0 {
+		return nil, errors.New("smtp notifier has no To addresses")
+	}
+	if settings.Server == "" && settings.Sendmail == "" {
+		return nil, errors.New("smtp notifier needs a Server or a Sendmail path")
+	}
+	if settings.Security == SS_None && settings.User != "" {
+		return nil, errors.New("smtp notifier can't send its User and Password without encryption, use starttls or tls")
+	}
+	n := &smtpNotifier{settings: settings}
+	n.dial = n.dialServer
+	return n, nil
+}
+
+func (n *smtpNotifier) Send(notification Notification) error {
+	recipients := slices.Clone(n.settings.To)
+	if notification.Email != "" && !slices.Contains(recipients, notification.Email) {
+		recipients = append(recipients, notification.Email)
+	}
+
+	message, err := buildMail(n.settings.From, recipients, notification)
+	if err != nil {
+		return err
+	}
+
+	if n.settings.Server != "" {
+		err := n.sendSmtp(recipients, message)
+		if err == nil || n.settings.Sendmail == "" {
+			return smtpPermanent(err)
+		}
+		notification.Event.logger().Warn("Cannot deliver the notification, falling back to sendmail", "server", n.settings.Server, "error", err)
+	}
+	return n.sendmail(recipients, message)
+}
+
+// smtpPermanent marks 5xx replies as permanent, i.e. refused credentials or recipients.
+func smtpPermanent(err error) error {
+	var reply *textproto.Error
+	if errors.As(err, &reply) && reply.Code >= 500 {
+		return &permanentError{err}
+	}
+	return err
+}
+
+func (n *smtpNotifier) address() (address string, host string) {
+	security := n.settings.Security
+	if security == "" {
+		security = SS_StartTLS
+	}
+
+	host, port, err := net.SplitHostPort(n.settings.Server)
+	if err != nil {
+		// No port, pick the usual one
+		host = n.settings.Server
+		switch security {
+		case SS_TLS:
+			port = "465"
+		case SS_StartTLS:
+			port = "587"
+		default:
+			port = "25"
+		}
+	}
+	return net.JoinHostPort(host, port), host
+}
+
+func (n *smtpNotifier) dialServer(address string, tlsConfig *tls.Config) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: notifyTimeout}
+	if n.settings.Security == SS_TLS {
+		return tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
+	}
+	return dialer.Dial("tcp", address)
+}
+
+func (n *smtpNotifier) sendSmtp(recipients []string, message []byte) error {
+	address, host := n.address()
+	tlsConfig := &tls.Config{ServerName: host}
+
+	conn, err := n.dial(address, tlsConfig)
+	if err != nil {
+		return fmt.Errorf("cannot connect to %v: %w", address, err)
+	}
+	conn.SetDeadline(time.Now().Add(notifyTimeout))
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("cannot talk to %v: %w", address, err)
+	}
+	defer client.Close()
+
+	if n.settings.Security == "" || n.settings.Security == SS_StartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("%v doesn't support STARTTLS", address)
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("STARTTLS failed: %w", err)
+		}
+	}
+
+	if n.settings.User != "" {
+		if err := client.Auth(smtp.PlainAuth("", n.settings.User, n.settings.Password, host)); err != nil {
+			return fmt.Errorf("authentication failed: %w", err)
+		}
+	}
+
+	if err := client.Mail(n.settings.From); err != nil {
+		return err
+	}
+	for _, recipient := range recipients {
+		if err := client.Rcpt(recipient); err != nil {
+			return fmt.Errorf("recipient %v refused: %w", recipient, err)
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(message); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+func (n *smtpNotifier) sendmail(recipients []string, message []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, n.settings.Sendmail, append([]string{"-i", "-f", n.settings.From, "--"}, recipients...)...)
+	cmd.Stdin = bytes.NewReader(message)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("sendmail failed: %w: %v", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// mailPriority maps a notification priority to the X-Priority header.
+func mailPriority(priority NotificationPriority) string {
+	switch priority {
+	case NP_Max, NP_Urgent:
+		return "1"
+	case NP_High:
+		return "2"
+	case NP_Low:
+		return "4"
+	case NP_Min:
+		return "5"
+	default:
+		return "3"
+	}
+}
+
+func buildMail(from string, recipients []string, notification Notification) ([]byte, error) {
+	var buf bytes.Buffer
+	body := multipart.NewWriter(&buf)
+
+	hostname, _ := os.Hostname()
+	headers := []string{
+		"From: " + from,
+		"To: " + strings.Join(recipients, ", "),
+		"Subject: " + mime.QEncoding.Encode("utf-8", notification.Title),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"Message-ID: <" + strconv.FormatInt(time.Now().UnixNano(), 36) + ".borgmox@" + hostname + ">",
+		"X-Priority: " + mailPriority(notification.Priority),
+		"MIME-Version: 1.0",
+		"Content-Type: multipart/alternative; boundary=" + body.Boundary(),
+	}
+	buf.WriteString(strings.Join(headers, "\r\n") + "\r\n\r\n")
+
+	parts := []struct {
+		contentType string
+		content     string
+	}{
+		{"text/plain; charset=utf-8", notification.Message},
+		{"text/html; charset=utf-8", mailHtml(notification)},
+	}
+	for _, part := range parts {
+		w, err := body.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := body.Close(); err != nil {
+		return nil, err
+	}
+
+	// Plain line feeds: sendmail wants them, and the SMTP client converts them to CRLF
+	return bytes.ReplaceAll(buf.Bytes(), []byte("\r\n"), []byte("\n")), nil
+}
+
+// mailHtml renders the notification, and the details of its event, as a small HTML page.
+func mailHtml(notification Notification) string {
+	event := notification.Event
+	var b strings.Builder
+
+	b.WriteString("<html><body>\n")
+	b.WriteString("<h2>" + html.EscapeString(notification.Title) + "</h2>\n")
+	b.WriteString("<pre>" + html.EscapeString(notification.Message) + "</pre>\n")
+
+	rows := [][2]string{}
+	if event.Job != "" {
+		rows = append(rows, [2]string{"Backup Job", event.Job})
+	}
+	rows = append(rows,
+		[2]string{"Phase", string(event.Phase)},
+		[2]string{"Outcome", string(event.Outcome)},
+	)
+	if event.VMID != 0 {
+		rows = append(rows, [2]string{"VM/LXC", event.guest(event.VMID).String()})
+	}
+	if event.Repository != "" {
+		rows = append(rows, [2]string{"Repository", event.Repository})
+	}
+	if event.Stats != nil && event.Stats.Bytes > 0 {
+		rows = append(rows,
+			[2]string{"Size", formatBytes(float64(event.Stats.Bytes))},
+			[2]string{"Duration", event.Stats.Duration.Round(time.Second).String()},
+			[2]string{"Throughput", formatBytes(event.Stats.Throughput()) + "/s"},
+			[2]string{"SHA-256", event.Stats.SHA256},
+		)
+	}
+	writeHtmlTable(&b, "", []string{}, rows)
+
+	if len(event.Succeeded) > 0 {
+		succeeded := make([][2]string, 0, len(event.Succeeded))
+		for _, vmid := range event.Succeeded {
+			succeeded = append(succeeded, [2]string{event.guest(vmid).String(), "OK"})
+		}
+		writeHtmlTable(&b, "Succeeded", []string{"VM/LXC", ""}, succeeded)
+	}
+	for _, section := range []struct {
+		title string
+		errs  map[uint64]error
+	}{
+		{"Failed", event.Failed},
+		{"Failed replicas", event.FailedReplicas},
+	} {
+		if len(section.errs) == 0 {
+			continue
+		}
+		rows := make([][2]string, 0, len(section.errs))
+		for _, vmid := range sortedErrorKeys(section.errs) {
+			rows = append(rows, [2]string{event.guest(vmid).String(), section.errs[vmid].Error()})
+		}
+		writeHtmlTable(&b, section.title, []string{"VM/LXC", "Error"}, rows)
+	}
+	if len(event.Orphans) > 0 {
+		rows := make([][2]string, 0, len(event.Orphans))
+		for _, orphan := range event.Orphans {
+			rows = append(rows, [2]string{strconv.FormatUint(orphan.VMID, 10), orphan.String()})
+		}
+		writeHtmlTable(&b, "Orphaned archives", []string{"VMID", ""}, rows)
+	}
+
+	b.WriteString("</body></html>\n")
+	return b.String()
+}
+
+func writeHtmlTable(b *strings.Builder, title string, header []string, rows [][2]string) {
+	if title != "" {
+		b.WriteString("<h3>" + html.EscapeString(title) + "</h3>\n")
+	}
+	b.WriteString("<table border=\"1\" cellpadding=\"4\" cellspacing=\"0\">\n")
+	if len(header) > 0 {
+		b.WriteString("<tr>")
+		for _, cell := range header {
+			b.WriteString("<th>" + html.EscapeString(cell) + "</th>")
+		}
+		b.WriteString("</tr>\n")
+	}
+	for _, row := range rows {
+		b.WriteString("<tr><td>" + html.EscapeString(row[0]) + "</td><td><pre>" + html.EscapeString(row[1]) + "</pre></td></tr>\n")
+	}
+	b.WriteString("</table>\n")
+}
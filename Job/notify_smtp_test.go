@@ -0,0 +1,191 @@
+package Job
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// smtpSession is what the fake SMTP server received.
+type smtpSession struct {
+	commands []string
+	data     string
+}
+
+// fakeSmtpServer answers a single SMTP session on conn. It advertises extensions,
+// and refuses the recipient refused with a 550.
+func fakeSmtpServer(conn net.Conn, extensions []string, refused string) <-chan smtpSession {
+	sessions := make(chan smtpSession, 1)
+	go func() {
+		defer conn.Close()
+		var session smtpSession
+		defer func() { sessions <- session }()
+
+		r := textproto.NewReader(bufio.NewReader(conn))
+		w := textproto.NewWriter(bufio.NewWriter(conn))
+		w.PrintfLine("220 fake ESMTP")
+		for {
+			line, err := r.ReadLine()
+			if err != nil {
+				return
+			}
+			session.commands = append(session.commands, line)
+
+			verb, _, _ := strings.Cut(line, " ")
+			switch strings.ToUpper(verb) {
+			case "EHLO":
+				w.PrintfLine("250-fake")
+				for _, extension := range extensions {
+					w.PrintfLine("250-%v", extension)
+				}
+				w.PrintfLine("250 8BITMIME")
+			case "RCPT":
+				if refused != "" && strings.Contains(line, "<"+refused+">") {
+					w.PrintfLine("550 no such user")
+				} else {
+					w.PrintfLine("250 ok")
+				}
+			case "DATA":
+				w.PrintfLine("354 go ahead")
+				lines, err := r.ReadDotLines()
+				if err != nil {
+					return
+				}
+				session.data = strings.Join(lines, "\n")
+				w.PrintfLine("250 queued")
+			case "QUIT":
+				w.PrintfLine("221 bye")
+				return
+			default:
+				w.PrintfLine("250 ok")
+			}
+		}
+	}()
+	return sessions
+}
+
+// newTestSmtpNotifier returns a notifier whose connections go to the fake SMTP server.
+func newTestSmtpNotifier(t *testing.T, settings SmtpSettings, extensions []string, refused string) (*smtpNotifier, <-chan smtpSession) {
+	t.Helper()
+	n, err := newSmtpNotifier(settings)
+	if err != nil {
+		t.Fatalf("newSmtpNotifier: %v", err)
+	}
+
+	client, server := net.Pipe()
+	sessions := fakeSmtpServer(server, extensions, refused)
+	n.dial = func(address string, tlsConfig *tls.Config) (net.Conn, error) {
+		return client, nil
+	}
+	return n, sessions
+}
+
+func testSmtpNotification() Notification {
+	return Notification{
+		Event: NotificationEvent{
+			Job:     "My Job",
+			Phase:   NPH_Backup,
+			Outcome: NO_Failure,
+		},
+		Title:    "Backup failed",
+		Message:  "qemu 100 (web) failed",
+		Priority: NP_High,
+		Email:    "boss@example.com",
+	}
+}
+
+func TestSmtpNotifierSendsMail(t *testing.T) {
+	n, sessions := newTestSmtpNotifier(t, SmtpSettings{
+		Server:   "mail.example.com:25",
+		Security: SS_None,
+		From:     "borgmox@example.com",
+		To:       []string{"ops@example.com"},
+	}, nil, "")
+
+	if err := n.Send(testSmtpNotification()); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	session := <-sessions
+
+	for _, want := range []string{
+		"MAIL FROM:<borgmox@example.com>",
+		"RCPT TO:<ops@example.com>",
+		"RCPT TO:<boss@example.com>",
+		"QUIT",
+	} {
+		found := false
+		for _, command := range session.commands {
+			found = found || strings.HasPrefix(command, want)
+		}
+		if !found {
+			t.Errorf("missing command %q in %q", want, session.commands)
+		}
+	}
+	for _, want := range []string{
+		"Subject: Backup failed",
+		"X-Priority: 2",
+		"Content-Type: multipart/alternative",
+		"qemu 100 (web) failed",
+	} {
+		if !strings.Contains(session.data, want) {
+			t.Errorf("missing %q in the mail:\n%v", want, session.data)
+		}
+	}
+}
+
+func TestSmtpNotifierRefusedRecipientIsPermanent(t *testing.T) {
+	n, sessions := newTestSmtpNotifier(t, SmtpSettings{
+		Server:   "mail.example.com:25",
+		Security: SS_None,
+		From:     "borgmox@example.com",
+		To:       []string{"ops@example.com"},
+	}, nil, "boss@example.com")
+
+	err := n.Send(testSmtpNotification())
+	<-sessions
+	if err == nil {
+		t.Fatal("Send succeeded, want a refused recipient")
+	}
+	if !isPermanent(err) {
+		t.Errorf("error %q isn't permanent", err)
+	}
+}
+
+func TestSmtpNotifierRequiresStartTLS(t *testing.T) {
+	n, sessions := newTestSmtpNotifier(t, SmtpSettings{
+		Server: "mail.example.com",
+		From:   "borgmox@example.com",
+		To:     []string{"ops@example.com"},
+	}, nil, "")
+
+	err := n.Send(testSmtpNotification())
+	session := <-sessions
+	if err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+		t.Fatalf("Send returned %v, want a STARTTLS error", err)
+	}
+	if isPermanent(err) {
+		t.Errorf("error %q is permanent", err)
+	}
+	for _, command := range session.commands {
+		if strings.HasPrefix(command, "MAIL") {
+			t.Errorf("the mail was sent without STARTTLS")
+		}
+	}
+}
+
+func TestNewSmtpNotifierRejectsPlainTextAuth(t *testing.T) {
+	_, err := newSmtpNotifier(SmtpSettings{
+		Server:   "mail.example.com:25",
+		Security: SS_None,
+		User:     "borgmox",
+		Password: "secret",
+		From:     "borgmox@example.com",
+		To:       []string{"ops@example.com"},
+	})
+	if err == nil {
+		t.Fatal("newSmtpNotifier accepted a User without encryption")
+	}
+}
@@ -0,0 +1,260 @@
+package Job
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const spoolDirectoryName = "spool"
+
+// Spooled notifications older than this are dropped instead of being sent
+const spoolMaxAge = 7 * 24 * time.Hour
+
+// spooledError keeps the message of an error across runs.
+type spooledError string
+
+func (e spooledError) Error() string {
+	return string(e)
+}
+
+type spooledOrphan struct {
+	OrphanResult
+	Error   string `json:",omitempty"`
+	Warning string `json:",omitempty"`
+}
+
+// spooledEvent replaces the errors of an event with their messages, which can be stored as JSON.
+type spooledEvent struct {
+	NotificationEvent
+	Error          string            `json:",omitempty"`
+	Failed         map[uint64]string `json:",omitempty"`
+	FailedReplicas map[uint64]string `json:",omitempty"`
+	Orphans        []spooledOrphan   `json:",omitempty"`
+	StaleOverrides string            `json:",omitempty"`
+}
+
+// spooledNotification is a notification that couldn't be delivered, along with the notifier it was meant for.
+type spooledNotification struct {
+	ID       string
+	Spooled  time.Time
+	Attempts int
+	Notifier NotifierBackend
+	Target   NotificationTargetInfo
+	Title    string
+	Message  string
+	Priority NotificationPriority
+	Email    string
+	Event    spooledEvent
+}
+
+func errorMessages(errs map[uint64]error) map[uint64]string {
+	if len(errs) == 0 {
+		return nil
+	}
+	messages := make(map[uint64]string, len(errs))
+	for vmid, err := range errs {
+		messages[vmid] = err.Error()
+	}
+	return messages
+}
+
+func messageErrors(messages map[uint64]string) map[uint64]error {
+	if len(messages) == 0 {
+		return nil
+	}
+	errs := make(map[uint64]error, len(messages))
+	for vmid, message := range messages {
+		errs[vmid] = spooledError(message)
+	}
+	return errs
+}
+
+func newSpooledEvent(event NotificationEvent) spooledEvent {
+	spooled := spooledEvent{
+		NotificationEvent: event,
+		Error:             errorString(event.Error),
+		Failed:            errorMessages(event.Failed),
+		FailedReplicas:    errorMessages(event.FailedReplicas),
+		StaleOverrides:    errorString(event.StaleOverrides),
+	}
+	for _, orphan := range event.Orphans {
+		spooled.Orphans = append(spooled.Orphans, spooledOrphan{
+			OrphanResult: orphan,
+			Error:        errorString(orphan.Error),
+			Warning:      errorString(orphan.Warning),
+		})
+	}
+	return spooled
+}
+
+func (e spooledEvent) event() NotificationEvent {
+	event := e.NotificationEvent
+	event.Error = nil
+	if e.Error != "" {
+		event.Error = spooledError(e.Error)
+	}
+	event.Failed = messageErrors(e.Failed)
+	event.FailedReplicas = messageErrors(e.FailedReplicas)
+	event.StaleOverrides = nil
+	if e.StaleOverrides != "" {
+		event.StaleOverrides = spooledError(e.StaleOverrides)
+	}
+	event.Orphans = nil
+	for _, spooled := range e.Orphans {
+		orphan := spooled.OrphanResult
+		orphan.Error = nil
+		if spooled.Error != "" {
+			orphan.Error = spooledError(spooled.Error)
+		}
+		orphan.Warning = nil
+		if spooled.Warning != "" {
+			orphan.Warning = spooledError(spooled.Warning)
+		}
+		event.Orphans = append(event.Orphans, orphan)
+	}
+	return event
+}
+
+func (n spooledNotification) notification() Notification {
+	return Notification{
+		ID:       n.ID,
+		Event:    n.Event.event(),
+		Target:   n.Target,
+		Title:    n.Title,
+		Message:  n.Message,
+		Priority: n.Priority,
+		Email:    n.Email,
+	}
+}
+
+func (s *JobData) spoolDirectory() string {
+	return filepath.Join(s.stateDirectory(), spoolDirectoryName)
+}
+
+// writeSpooled stores a notification in the spool directory. It holds the notifier credentials, only root can read it.
+func writeSpooled(path string, spooled spooledNotification) error {
+	data, err := json.MarshalIndent(spooled, "", "\t")
+	if err != nil {
+		return fmt.Errorf("couldn't encode notification: %w", err)
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("couldn't write spool file %v: %w", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("couldn't replace spool file %v: %w", path, err)
+	}
+	return nil
+}
+
+// spool stores a notification that couldn't be delivered, to be sent again on the next run.
+func (s *JobData) spool(settings NotifierBackend, notification Notification) error {
+	directory := s.spoolDirectory()
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return fmt.Errorf("couldn't create spool directory: %w", err)
+	}
+
+	now := time.Now()
+	path := filepath.Join(directory, strconv.FormatInt(now.UnixNano(), 10)+".json")
+	return writeSpooled(path, spooledNotification{
+		ID:       notification.ID,
+		Spooled:  now,
+		Attempts: notifyAttempts,
+		Notifier: settings,
+		Target:   notification.Target,
+		Title:    notification.Title,
+		Message:  notification.Message,
+		Priority: notification.Priority,
+		Email:    notification.Email,
+		Event:    newSpooledEvent(notification.Event),
+	})
+}
+
+// flushSpool sends the notifications spooled by the previous runs, once each, oldest first.
+// Delivered and expired notifications are removed; the errors of the others are returned by Backup Job,
+// the notifications of no job (i.e. the digest) under "".
+// Once a notifier fails, its other notifications stay in the spool without being sent.
+func (s *JobData) flushSpool() map[string][]error {
+	failures := map[string][]error{}
+
+	directory := s.spoolDirectory()
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Error("Cannot read the notification spool", "directory", directory, "error", err)
+		}
+		return failures
+	}
+
+	names := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		path := filepath.Join(directory, name)
+
+		var spooled spooledNotification
+		if data, err := os.ReadFile(path); err != nil {
+			slog.Error("Cannot read a spooled notification", "path", path, "error", err)
+			continue
+		} else if err := json.Unmarshal(data, &spooled); err != nil {
+			slog.Warn("Dropping an unreadable spooled notification", "path", path, "error", err)
+			os.Remove(path)
+			continue
+		}
+
+		// Spooled by an older version, the ID is kept from now on
+		if spooled.ID == "" {
+			spooled.ID = newNotificationID()
+		}
+		event := spooled.Event.event()
+		if time.Since(spooled.Spooled) > spoolMaxAge {
+			event.logger().Warn("Dropping a spooled notification, it was undeliverable for too long",
+				"spooled", spooled.Spooled.Format(time.RFC3339), "max_age", spoolMaxAge)
+			os.Remove(path)
+			continue
+		}
+
+		err, failed := s.failedNotifiers[spooled.Notifier.key()]
+		if failed {
+			failures[event.Job] = append(failures[event.Job], fmt.Errorf("spooled %v notification through %v: %w", string(event.Phase), string(spooled.Notifier.Type), err))
+			continue
+		}
+		if notifier, notifierErr := newNotifier(spooled.Notifier); notifierErr != nil {
+			err = notifierErr
+		} else {
+			err = notifier.Send(spooled.notification())
+		}
+		if err == nil {
+			event.logger().Info("Sent a spooled notification", "spooled", spooled.Spooled.Format(time.RFC3339))
+			os.Remove(path)
+			continue
+		}
+
+		event.logger().Error("Cannot send a spooled notification", "spooled", spooled.Spooled.Format(time.RFC3339), "notifier", string(spooled.Notifier.Type), "error", err)
+		failures[event.Job] = append(failures[event.Job], fmt.Errorf("spooled %v notification through %v: %w", string(event.Phase), string(spooled.Notifier.Type), err))
+		if isPermanent(err) {
+			os.Remove(path)
+			continue
+		}
+		s.notifierFailed(spooled.Notifier, err)
+		spooled.Attempts++
+		if err := writeSpooled(path, spooled); err != nil {
+			slog.Error("Cannot update a spooled notification", "path", path, "error", err)
+		}
+	}
+	return failures
+}
@@ -0,0 +1,447 @@
+package Job
+
+import (
+	"borgmox/BorgCLI"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// NotificationGuest is a VM/LXC, as seen by the notification templates.
+type NotificationGuest struct {
+	VMID uint64
+	Name string
+	// "VM", "LXC", or "VM/LXC" when unknown
+	Type string
+	Node string
+	// Why the VM/LXC failed, in the Failed and FailedReplicas lists
+	Error string
+
+	// Backup stats, zero when no backup ran
+	Bytes      uint64
+	Duration   time.Duration
+	Throughput float64
+	SHA256     string
+	// What the backup added to the primary repository
+	Deduplicated uint64
+}
+
+// String formats the guest as "VM 100 (name)".
+func (g NotificationGuest) String() string {
+	str := g.Type + " " + strconv.FormatUint(g.VMID, 10)
+	if g.Name != "" {
+		str += " (" + g.Name + ")"
+	}
+	return str
+}
+
+// NotificationData is what TitleTemplate and BodyTemplate are executed against.
+type NotificationData struct {
+	Job      string
+	Host     string
+	Time     time.Time
+	Phase    string
+	Outcome  string
+	Priority string
+	// "vm" for the notifications of a single VM/LXC, "job" otherwise
+	Scope string
+
+	// The VM/LXC of a "vm" notification
+	Guest      NotificationGuest
+	Repository string
+	Error      string
+
+	// Job summaries
+	Succeeded      []NotificationGuest
+	Failed         []NotificationGuest
+	FailedReplicas []NotificationGuest
+	TotalBytes     uint64
+	Orphans        []OrphanResult
+	Compact        bool
+
+	Check BorgCLI.CheckResult
+
+	// The digest of the run, nil for the other notifications
+	Digest *RunDigest
+
+	// The built-in title and message, to be wrapped by custom templates
+	DefaultTitle string
+	DefaultBody  string
+}
+
+var notificationTemplateFuncs = template.FuncMap{
+	"bytes": func(value any) string {
+		switch v := value.(type) {
+		case uint64:
+			return formatBytes(float64(v))
+		case float64:
+			return formatBytes(v)
+		default:
+			return fmt.Sprint(value)
+		}
+	},
+	"duration": func(d time.Duration) string {
+		return d.Round(time.Second).String()
+	},
+	"join":     strings.Join,
+	"upper":    strings.ToUpper,
+	"lower":    strings.ToLower,
+	"markdown": markdownEscape,
+}
+
+// The characters that change the inline formatting of Markdown, i.e. the underscores of archive names.
+// Line starts (lists, headings) are left alone, the built-in templates rely on them.
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "`", "\\`", "*", `\*`, "_", `\_`, "~", `\~`,
+	"[", `\[`, "]", `\]`, "<", `\<`, ">", `\>`, "|", `\|`,
+)
+
+// markdownEscape makes plain text show as is when rendered as Markdown.
+func markdownEscape(text string) string {
+	return markdownEscaper.Replace(text)
+}
+
+// The built-in templates are named after the phase and the scope of the notification.
+const defaultNotificationTemplates = `
+{{- define "backup vm title"}}{{.Guest.Type}} backup {{if eq .Outcome "failure"}}failed{{else if eq .Outcome "partial"}}partially completed{{else}}completed{{end}}!{{end}}
+
+{{- define "backup vm body"}}
+{{- if eq .Outcome "failure"}}{{.Guest}}: Backup failed!
+{{.Error}}
+{{- else}}{{.Guest}}: Backup completed{{if eq .Outcome "partial"}}, but some replicas failed{{end}}!
+{{- with .Guest}}{{if .Bytes}}
+{{bytes .Bytes}} in {{duration .Duration}} ({{bytes .Throughput}}/s){{end}}{{end}}
+{{- if .Error}}
+{{.Error}}{{end}}
+{{- end}}
+{{- end}}
+
+{{- define "backup job title"}}
+{{- if eq .Outcome "success"}}Backup Job completed!
+{{- else if and .Succeeded .Failed}}Backup Job incomplete!
+{{- else if .Failed}}Backup Job failed!
+{{- else}}Backup Job partially completed!{{end}}
+{{- end}}
+
+{{- define "backup job body"}}
+{{- if eq .Outcome "success"}}All VM/LXC backup jobs succeeded!
+{{- else if and .Succeeded .Failed}}Some VM/LXC backup jobs failed!
+{{- else if .Failed}}All VM/LXC backup jobs failed!
+{{- else}}All VM/LXC backups reached the primary repository, but some replicas failed!{{end}}
+{{- if .Succeeded}}
+
+Succeeded{{if .TotalBytes}} ({{bytes .TotalBytes}}){{end}}:
+{{- range .Succeeded}}
+- {{.}}{{if .Bytes}}: {{bytes .Bytes}} in {{duration .Duration}}{{end}}
+{{- end}}
+{{- end}}
+{{- if .Failed}}
+
+Failed:
+{{- range .Failed}}
+- {{.}}: {{.Error}}
+{{- end}}
+{{- end}}
+{{- if .FailedReplicas}}
+
+Failed replicas:
+{{- range .FailedReplicas}}
+- {{.}}: {{.Error}}
+{{- end}}
+{{- end}}
+{{- end}}
+
+{{- define "prune vm title"}}Archive prune {{if eq .Outcome "success"}}completed{{else}}failed{{end}}!{{end}}
+
+{{- define "prune vm body"}}
+{{- if eq .Outcome "success"}}{{.Guest}} archives: Prune completed!
+{{- else}}{{.Guest}} archives: Prune failed!
+{{.Error}}{{end}}
+{{- end}}
+
+{{- define "prune job title"}}Prune Job {{if eq .Outcome "success"}}completed{{else if eq .Outcome "partial"}}incomplete{{else}}failed{{end}}!{{end}}
+
+{{- define "prune job body"}}
+{{- if eq .Outcome "success"}}All VM/LXC prune and compact jobs succeeded!
+{{- else}}
+{{- if eq .Outcome "partial"}}Some VM/LXC prune jobs failed!
+{{- if or .Succeeded (and .Compact (not .Error))}}
+
+Succeeded:
+{{- range .Succeeded}}
+- {{.}}
+{{- end}}
+{{- if and .Compact (not .Error)}}
+- Compact job
+{{- end}}
+{{- end}}
+{{- else}}All VM/LXC prune jobs failed!{{end}}
+{{- if or .Failed .Error}}
+
+Failed:
+{{- range .Failed}}
+- {{.}}: {{.Error}}
+{{- end}}
+{{- if .Error}}
+- Compact job: {{.Error}}
+{{- end}}
+{{- end}}
+{{- end}}
+{{- if .Orphans}}
+
+Orphaned archives:
+{{- range .Orphans}}
+- {{.}}
+{{- end}}
+{{- end}}
+{{- if .StaleOverrides}}
+
+Stale prune overrides, the other VMs/LXCs were pruned as usual:
+{{.StaleOverrides}}
+{{- end}}
+{{- end}}
+
+{{- define "prune guard job title"}}Prune guard tripped!{{end}}
+
+{{- define "prune guard job body"}}Some VM/LXC prunes were refused by the safety guards, no archive was deleted for them!
+{{range .Failed}}
+- {{.}}: {{.Error}}
+{{- end}}
+{{- end}}
+
+{{- define "orphans vm title"}}
+{{- with .Orphans}}{{with index . 0}}
+{{- if eq .Decision "pruned"}}Orphaned archives pruned!
+{{- else if eq .Decision "kept"}}Orphaned archives kept!
+{{- else if eq .Decision "reported"}}Orphaned archives found!
+{{- else if .Prefix}}Orphaned archive prune failed!
+{{- else}}Orphaned archives couldn't be listed!{{end}}
+{{- end}}{{end}}
+{{- end}}
+
+{{- define "orphans vm body"}}
+{{- range $i, $orphan := .Orphans}}{{if $i}}
+{{end}}Orphaned archives: {{$orphan}}{{end}}
+{{- end}}
+
+{{- define "compact vm title"}}Repository compact {{if eq .Outcome "success"}}succeeded{{else}}failed{{end}}!{{end}}
+
+{{- define "compact vm body"}}
+{{- if eq .Outcome "success"}}Repository: Compact succeeded!
+{{- else}}Repository: Compact failed!
+{{.Error}}{{end}}
+{{- end}}
+
+{{- define "check job title"}}Repository check {{if eq .Outcome "success"}}completed{{else}}failed{{end}}!{{end}}
+
+{{- define "check job body"}}
+{{- if ne .Outcome "success"}}Backup Job {{.Job}}: Repository {{.Repository}} check failed!
+{{.Error}}
+{{- else}}Backup Job {{.Job}}: {{if .Check.Partial}}Partial repository{{else}}Repository{{end}} {{.Repository}} check completed!
+{{- range .Check.Problems}}
+{{.}}
+{{- end}}
+{{- end}}
+{{- end}}
+
+{{- define "audit job title"}}{{if eq .Outcome "success"}}Backup audit passed!{{else}}Backup audit failed!{{end}}{{end}}
+
+{{- define "audit job body"}}
+{{- if eq .Outcome "success"}}Every VM/LXC has a recent backup!
+{{- else if .Failed}}Some VM/LXC have no recent backup!
+{{- else}}The backups of some repositories couldn't be audited!{{end}}
+{{- if .Failed}}
+
+Stale or missing:
+{{- range .Failed}}
+- {{.}}: {{.Error}}
+{{- end}}
+{{- end}}
+{{- if .Error}}
+
+{{.Error}}{{end}}
+{{- if .Succeeded}}
+
+Recent:
+{{- range .Succeeded}}
+- {{.}}
+{{- end}}
+{{- end}}
+{{- end}}
+
+{{- define "digest row"}}
+{{printf "%-20.20s %-8s %7v %7v %-7s %10v %10v %9v" .Job .Outcome (printf "%v/%v" .SucceededBackups .Backups) (printf "%v/%v" .SucceededPrunes .Prunes) .Compact (bytes .Bytes) (bytes .Deduplicated) (duration .Duration)}}
+{{- end}}
+
+{{- define "digest job title"}}Backup run {{if eq .Outcome "success"}}completed{{else if eq .Outcome "partial"}}partially completed{{else}}failed{{end}}!{{end}}
+
+{{- define "digest job body"}}
+{{- with .Digest}}
+{{- printf "%-20s %-8s %7v %7v %-7s %10v %10v %9v" "Job" "Outcome" "Backups" "Prunes" "Compact" "Size" "Added" "Time"}}
+{{- range .Jobs}}{{template "digest row" .}}{{end}}
+{{- template "digest row" .Total}}
+{{- with .Slowest}}
+
+Slowest backup: {{.}} in {{.Job}}, {{duration .Duration}} for {{bytes .Bytes}}
+{{- end}}
+{{- with .LargestGrowth}}
+Largest growth: {{.}} in {{.Job}}, {{bytes .Deduplicated}} added
+{{- end}}
+{{- end}}
+{{- if .Error}}
+
+Errors:
+{{.Error}}
+{{- end}}
+{{- end}}
+
+{{- define "generic title"}}Backup Job {{.Job}}: {{.Phase}} {{.Outcome}}{{end}}
+{{- define "generic body"}}{{end}}
+`
+
+var defaultTemplates = template.Must(template.New("default").Funcs(notificationTemplateFuncs).Parse(defaultNotificationTemplates))
+
+// parseNotificationTemplate parses a TitleTemplate or a BodyTemplate, returning nil when it's empty.
+func parseNotificationTemplate(name string, text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	t, err := template.New(name).Funcs(notificationTemplateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %v: %w", name, err)
+	}
+	return t, nil
+}
+
+func (n NotificationTemplates) validateTemplates() error {
+	if _, err := parseNotificationTemplate("TitleTemplate", n.TitleTemplate); err != nil {
+		return err
+	}
+	_, err := parseNotificationTemplate("BodyTemplate", n.BodyTemplate)
+	return err
+}
+
+func executeTemplate(t *template.Template, name string, data NotificationData) (string, error) {
+	var b strings.Builder
+	if err := t.ExecuteTemplate(&b, name, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// guest describes a VM/LXC of the event, with its backup stats when it was backed up.
+func (e NotificationEvent) guest(vmid uint64) NotificationGuest {
+	machine, ok := e.Machines[vmid]
+	machineType := machine.Type
+	if !ok || vmid == e.VMID && e.MachineType != "" {
+		machineType = e.MachineType
+	}
+
+	guest := NotificationGuest{
+		VMID: vmid,
+		Name: machine.Name,
+		Type: machineTypeName(machineType),
+		Node: machine.Node,
+	}
+
+	stats, ok := e.BackupStats[vmid]
+	if vmid == e.VMID && e.Stats != nil {
+		stats, ok = *e.Stats, true
+	}
+	if ok {
+		guest.Bytes = stats.Bytes
+		guest.Duration = stats.Duration
+		guest.Throughput = stats.Throughput()
+		guest.SHA256 = stats.SHA256
+		guest.Deduplicated = stats.Deduplicated
+	}
+	return guest
+}
+
+func (e NotificationEvent) guests(errs map[uint64]error) []NotificationGuest {
+	guests := make([]NotificationGuest, 0, len(errs))
+	for _, vmid := range sortedErrorKeys(errs) {
+		guest := e.guest(vmid)
+		guest.Error = errs[vmid].Error()
+		guests = append(guests, guest)
+	}
+	return guests
+}
+
+func newNotificationData(event NotificationEvent, priority NotificationPriority) NotificationData {
+	hostname, _ := os.Hostname()
+	data := NotificationData{
+		Job:            event.Job,
+		Host:           hostname,
+		Time:           time.Now(),
+		Phase:          string(event.Phase),
+		Outcome:        string(event.Outcome),
+		Priority:       string(priority),
+		Scope:          "job",
+		Repository:     event.Repository,
+		Error:          errorString(event.Error),
+		Failed:         event.guests(event.Failed),
+		FailedReplicas: event.guests(event.FailedReplicas),
+		Orphans:        event.Orphans,
+		Compact:        event.Compact,
+		Check:          event.Check,
+		Digest:         event.Digest,
+	}
+	if event.Frequency == NF_EveryVmFinished {
+		data.Scope = "vm"
+	}
+	if event.VMID != 0 {
+		data.Guest = event.guest(event.VMID)
+	}
+	for _, vmid := range event.Succeeded {
+		guest := event.guest(vmid)
+		data.TotalBytes += guest.Bytes
+		data.Succeeded = append(data.Succeeded, guest)
+	}
+	return data
+}
+
+// render executes the templates of the notifier, falling back to the built-in ones.
+// When the message is rendered as Markdown, the built-in message is escaped, custom templates escape with "markdown".
+func (n NotificationTemplates) render(event NotificationEvent, priority NotificationPriority, markdown bool) (title string, message string, err error) {
+	data := newNotificationData(event, priority)
+	name := data.Phase + " " + data.Scope
+	if defaultTemplates.Lookup(name+" title") == nil {
+		name = "generic"
+	}
+	if data.DefaultTitle, err = executeTemplate(defaultTemplates, name+" title", data); err != nil {
+		return "", "", err
+	}
+	if data.DefaultBody, err = executeTemplate(defaultTemplates, name+" body", data); err != nil {
+		return "", "", err
+	}
+	if markdown {
+		data.DefaultBody = markdownEscape(data.DefaultBody)
+	}
+	title, message = data.DefaultTitle, data.DefaultBody
+
+	titleTemplate, err := parseNotificationTemplate("TitleTemplate", n.TitleTemplate)
+	if err != nil {
+		return data.DefaultTitle, data.DefaultBody, err
+	}
+	if titleTemplate != nil {
+		if title, err = executeTemplate(titleTemplate, "TitleTemplate", data); err != nil {
+			return data.DefaultTitle, data.DefaultBody, fmt.Errorf("TitleTemplate: %w", err)
+		}
+	}
+
+	bodyTemplate, err := parseNotificationTemplate("BodyTemplate", n.BodyTemplate)
+	if err != nil {
+		return data.DefaultTitle, data.DefaultBody, err
+	}
+	if bodyTemplate != nil {
+		if message, err = executeTemplate(bodyTemplate, "BodyTemplate", data); err != nil {
+			return data.DefaultTitle, data.DefaultBody, fmt.Errorf("BodyTemplate: %w", err)
+		}
+	}
+
+	return strings.TrimSpace(title), message, nil
+}
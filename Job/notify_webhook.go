@@ -0,0 +1,428 @@
+package Job
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+type WebhookPreset string
+
+const (
+	WP_Json    WebhookPreset = "json"
+	WP_Slack   WebhookPreset = "slack"
+	WP_Discord WebhookPreset = "discord"
+	WP_Matrix  WebhookPreset = "matrix"
+	WP_Gotify  WebhookPreset = "gotify"
+	WP_Teams   WebhookPreset = "teams"
+
+	// Version of the "json" preset document, bumped on incompatible changes
+	webhookDocumentVersion = 1
+)
+
+type WebhookSettings struct {
+	URL    string
+	Preset WebhookPreset
+	// Signs the body with HMAC-SHA256, empty to disable
+	Secret  string
+	Headers map[string]string
+}
+
+type webhookNotifier struct {
+	settings WebhookSettings
+}
+
+func newWebhookNotifier(settings WebhookSettings) (*webhookNotifier, error) {
+	switch settings.Preset {
+	case "", WP_Json, WP_Slack, WP_Discord, WP_Matrix, WP_Gotify, WP_Teams:
+	default:
+		return nil, fmt.Errorf("invalid webhook preset: %v", string(settings.Preset))
+	}
+	if settings.URL == "" {
+		return nil, errors.New("webhook notifier has no URL")
+	}
+	return &webhookNotifier{settings: settings}, nil
+}
+
+// WebhookStats is the "stats" object of the webhook document.
+type WebhookStats struct {
+	Bytes             uint64  `json:"bytes"`
+	DurationSeconds   float64 `json:"duration_seconds"`
+	BytesPerSecond    float64 `json:"bytes_per_second"`
+	SHA256            string  `json:"sha256,omitempty"`
+	DeduplicatedBytes uint64  `json:"deduplicated_bytes"`
+}
+
+// WebhookResult is the outcome of a single VM/LXC in the webhook document.
+type WebhookResult struct {
+	VMID   uint64        `json:"vmid"`
+	Name   string        `json:"name,omitempty"`
+	Status string        `json:"status"`
+	Error  string        `json:"error,omitempty"`
+	Stats  *WebhookStats `json:"stats,omitempty"`
+}
+
+type WebhookOrphan struct {
+	Repository string `json:"repository"`
+	VMID       uint64 `json:"vmid"`
+	Type       string `json:"type,omitempty"`
+	Archives   int    `json:"archives"`
+	Decision   string `json:"decision"`
+	Reason     string `json:"reason,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Warning    string `json:"warning,omitempty"`
+}
+
+type WebhookCheck struct {
+	Partial  bool     `json:"partial"`
+	Problems []string `json:"problems,omitempty"`
+}
+
+// WebhookDocument is the body posted by the "json" preset.
+type WebhookDocument struct {
+	Version        int             `json:"version"`
+	BorgmoxVersion string          `json:"borgmox_version"`
+	Host           string          `json:"host"`
+	Time           time.Time       `json:"time"`
+	Job            string          `json:"job"`
+	Phase          string          `json:"phase"`
+	Outcome        string          `json:"outcome"`
+	Scope          string          `json:"scope"`
+	Priority       string          `json:"priority"`
+	Title          string          `json:"title"`
+	Message        string          `json:"message"`
+	VMID           uint64          `json:"vmid,omitempty"`
+	Name           string          `json:"name,omitempty"`
+	Type           string          `json:"type,omitempty"`
+	Repository     string          `json:"repository,omitempty"`
+	Error          string          `json:"error,omitempty"`
+	Stats          *WebhookStats   `json:"stats,omitempty"`
+	Results        []WebhookResult `json:"results,omitempty"`
+	Orphans        []WebhookOrphan `json:"orphans,omitempty"`
+	StaleOverrides string          `json:"stale_overrides,omitempty"`
+	Check          *WebhookCheck   `json:"check,omitempty"`
+	Digest         *WebhookDigest  `json:"digest,omitempty"`
+}
+
+// WebhookDigestJob is a job of the "digest" object.
+type WebhookDigestJob struct {
+	Job              string  `json:"job"`
+	Outcome          string  `json:"outcome"`
+	Error            string  `json:"error,omitempty"`
+	Backups          int     `json:"backups"`
+	SucceededBackups int     `json:"succeeded_backups"`
+	Prunes           int     `json:"prunes"`
+	SucceededPrunes  int     `json:"succeeded_prunes"`
+	Compact          string  `json:"compact"`
+	Bytes            uint64  `json:"bytes"`
+	Deduplicated     uint64  `json:"deduplicated_bytes"`
+	DurationSeconds  float64 `json:"duration_seconds"`
+}
+
+// WebhookDigestGuest is a VM/LXC that stands out in the "digest" object.
+type WebhookDigestGuest struct {
+	Job   string        `json:"job"`
+	VMID  uint64        `json:"vmid"`
+	Name  string        `json:"name,omitempty"`
+	Stats *WebhookStats `json:"stats"`
+}
+
+// WebhookDigest is the "digest" object of the webhook document, sent once per run.
+type WebhookDigest struct {
+	Jobs          []WebhookDigestJob  `json:"jobs"`
+	Total         WebhookDigestJob    `json:"total"`
+	Slowest       *WebhookDigestGuest `json:"slowest,omitempty"`
+	LargestGrowth *WebhookDigestGuest `json:"largest_growth,omitempty"`
+}
+
+func webhookDigestJob(row DigestJob) WebhookDigestJob {
+	return WebhookDigestJob{
+		Job:              row.Job,
+		Outcome:          string(row.Outcome),
+		Error:            row.Error,
+		Backups:          row.Backups,
+		SucceededBackups: row.SucceededBackups,
+		Prunes:           row.Prunes,
+		SucceededPrunes:  row.SucceededPrunes,
+		Compact:          row.Compact,
+		Bytes:            row.Bytes,
+		Deduplicated:     row.Deduplicated,
+		DurationSeconds:  row.Duration.Seconds(),
+	}
+}
+
+func webhookDigestGuest(guest *DigestGuest) *WebhookDigestGuest {
+	if guest == nil {
+		return nil
+	}
+	return &WebhookDigestGuest{
+		Job:  guest.Job,
+		VMID: guest.VMID,
+		Name: guest.Name,
+		Stats: webhookStats(StreamStats{
+			Bytes:        guest.Bytes,
+			Duration:     guest.Duration,
+			SHA256:       guest.SHA256,
+			Deduplicated: guest.Deduplicated,
+		}),
+	}
+}
+
+func webhookDigest(digest *RunDigest) *WebhookDigest {
+	doc := &WebhookDigest{
+		Jobs:          []WebhookDigestJob{},
+		Total:         webhookDigestJob(digest.Total),
+		Slowest:       webhookDigestGuest(digest.Slowest),
+		LargestGrowth: webhookDigestGuest(digest.LargestGrowth),
+	}
+	for _, row := range digest.Jobs {
+		doc.Jobs = append(doc.Jobs, webhookDigestJob(row))
+	}
+	return doc
+}
+
+func webhookStats(stats StreamStats) *WebhookStats {
+	return &WebhookStats{
+		Bytes:             stats.Bytes,
+		DurationSeconds:   stats.Duration.Seconds(),
+		BytesPerSecond:    stats.Throughput(),
+		SHA256:            stats.SHA256,
+		DeduplicatedBytes: stats.Deduplicated,
+	}
+}
+
+func webhookOrphan(orphan OrphanResult) WebhookOrphan {
+	return WebhookOrphan{
+		Repository: orphan.Repository,
+		VMID:       orphan.VMID,
+		Type:       string(orphan.Type),
+		Archives:   orphan.Archives,
+		Decision:   string(orphan.Decision),
+		Reason:     orphan.Reason,
+		Error:      errorString(orphan.Error),
+		Warning:    errorString(orphan.Warning),
+	}
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func newWebhookDocument(notification Notification) WebhookDocument {
+	event := notification.Event
+	hostname, _ := os.Hostname()
+
+	doc := WebhookDocument{
+		Version:        webhookDocumentVersion,
+		BorgmoxVersion: BorgmoxVersion,
+		Host:           hostname,
+		Time:           time.Now().UTC(),
+		Job:            event.Job,
+		Phase:          string(event.Phase),
+		Outcome:        string(event.Outcome),
+		Scope:          "job",
+		Priority:       string(notification.Priority),
+		Title:          notification.Title,
+		Message:        notification.Message,
+		VMID:           event.VMID,
+		Name:           event.Machines[event.VMID].Name,
+		Type:           string(event.MachineType),
+		Repository:     event.Repository,
+		Error:          errorString(event.Error),
+	}
+	if event.Frequency == NF_EveryVmFinished {
+		doc.Scope = "vm"
+	}
+	if event.Stats != nil && event.Stats.Bytes > 0 {
+		doc.Stats = webhookStats(*event.Stats)
+	}
+
+	for _, vmid := range event.Succeeded {
+		result := WebhookResult{
+			VMID:   vmid,
+			Name:   event.Machines[vmid].Name,
+			Status: "succeeded",
+		}
+		if err, ok := event.FailedReplicas[vmid]; ok {
+			result.Status = "partial"
+			result.Error = errorString(err)
+		}
+		if stats, ok := event.BackupStats[vmid]; ok && stats.Bytes > 0 {
+			result.Stats = webhookStats(stats)
+		}
+		doc.Results = append(doc.Results, result)
+	}
+	for _, vmid := range sortedErrorKeys(event.Failed) {
+		doc.Results = append(doc.Results, WebhookResult{
+			VMID:   vmid,
+			Name:   event.Machines[vmid].Name,
+			Status: "failed",
+			Error:  errorString(event.Failed[vmid]),
+		})
+	}
+
+	for _, orphan := range event.Orphans {
+		doc.Orphans = append(doc.Orphans, webhookOrphan(orphan))
+	}
+	doc.StaleOverrides = errorString(event.StaleOverrides)
+
+	if event.Phase == NPH_Check {
+		doc.Check = &WebhookCheck{
+			Partial:  event.Check.Partial,
+			Problems: event.Check.Problems,
+		}
+	}
+	if event.Digest != nil {
+		doc.Digest = webhookDigest(event.Digest)
+	}
+	return doc
+}
+
+// outcomeColor returns a red/yellow/green color for chat presets.
+func outcomeColor(outcome NotificationOutcome) int {
+	switch outcome {
+	case NO_Success:
+		return 0x2eb67d
+	case NO_Partial:
+		return 0xecb22e
+	default:
+		return 0xe01e5a
+	}
+}
+
+// gotifyPriority maps a notification priority to the 0-10 range of Gotify.
+func gotifyPriority(priority NotificationPriority) int {
+	switch priority {
+	case NP_Max:
+		return 10
+	case NP_Urgent:
+		return 8
+	case NP_High:
+		return 6
+	case NP_Low:
+		return 2
+	case NP_Min:
+		return 1
+	default:
+		return 4
+	}
+}
+
+// truncate shortens str to max characters, without splitting any of them.
+func truncate(str string, max int) string {
+	if utf8.RuneCountInString(str) <= max {
+		return str
+	}
+	return string([]rune(str)[:max-3]) + "..."
+}
+
+// payload builds the request body, and the method, of the configured preset.
+func (n *webhookNotifier) payload(notification Notification) (method string, url string, body any) {
+	text := notification.Title + "\n" + notification.Message
+	url = n.settings.URL
+
+	switch n.settings.Preset {
+	case WP_Slack:
+		return "POST", url, map[string]any{
+			"text": "*" + notification.Title + "*\n" + notification.Message,
+			"attachments": []map[string]any{{
+				"color": fmt.Sprintf("#%06x", outcomeColor(notification.Event.Outcome)),
+				"text":  notification.Event.label() + ": " + string(notification.Event.Phase) + " " + string(notification.Event.Outcome),
+			}},
+		}
+	case WP_Discord:
+		return "POST", url, map[string]any{
+			"embeds": []map[string]any{{
+				"title":       truncate(notification.Title, 256),
+				"description": truncate(notification.Message, 4096),
+				"color":       outcomeColor(notification.Event.Outcome),
+				"footer":      map[string]string{"text": notification.Event.label()},
+			}},
+		}
+	case WP_Matrix:
+		// The URL points to the room's /send/m.room.message endpoint, which wants a transaction ID:
+		// Matrix ignores the retries of a message it already received under the same one
+		return "PUT", strings.TrimSuffix(url, "/") + "/borgmox" + notification.ID, map[string]any{
+			"msgtype":        "m.text",
+			"body":           text,
+			"format":         "org.matrix.custom.html",
+			"formatted_body": "<b>" + html.EscapeString(notification.Title) + "</b><br><pre>" + html.EscapeString(notification.Message) + "</pre>",
+		}
+	case WP_Gotify:
+		return "POST", url, map[string]any{
+			"title":    notification.Title,
+			"message":  notification.Message,
+			"priority": gotifyPriority(notification.Priority),
+		}
+	case WP_Teams:
+		return "POST", url, map[string]any{
+			"type": "message",
+			"attachments": []map[string]any{{
+				"contentType": "application/vnd.microsoft.card.adaptive",
+				"content": map[string]any{
+					"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+					"type":    "AdaptiveCard",
+					"version": "1.4",
+					"body": []map[string]any{
+						{"type": "TextBlock", "text": notification.Title, "weight": "Bolder", "size": "Medium", "wrap": true},
+						{"type": "TextBlock", "text": notification.Message, "wrap": true},
+					},
+				},
+			}},
+		}
+	default:
+		return "POST", url, newWebhookDocument(notification)
+	}
+}
+
+// webhookSignature signs a timestamp and a body, so that receivers can reject forged and replayed requests.
+func webhookSignature(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (n *webhookNotifier) Send(notification Notification) error {
+	method, url, payload := n.payload(notification)
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "borgmox/"+BorgmoxVersion)
+	for key, value := range n.settings.Headers {
+		req.Header.Set(key, value)
+	}
+	if n.settings.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Borgmox-Timestamp", timestamp)
+		req.Header.Set("X-Borgmox-Signature", webhookSignature(n.settings.Secret, timestamp, body))
+	}
+
+	res, err := notifyHttpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return checkHttpResponse("webhook", res)
+}
@@ -0,0 +1,59 @@
+package Job
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		str  string
+		max  int
+		want string
+	}{
+		{str: "short", max: 10, want: "short"},
+		{str: "exactly 10", max: 10, want: "exactly 10"},
+		{str: "a bit too long", max: 10, want: "a bit t..."},
+		{str: "èèèèèèèèèèèè", max: 10, want: "èèèèèèè..."},
+		{str: "backup ✅✅✅✅✅", max: 10, want: "backup ..."},
+	}
+
+	for _, test := range tests {
+		t.Run(test.str, func(t *testing.T) {
+			got := truncate(test.str, test.max)
+			if got != test.want {
+				t.Errorf("truncate = %q, want %q", got, test.want)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("truncate returned invalid UTF-8 %q", got)
+			}
+		})
+	}
+}
+
+func TestMatrixTransactionID(t *testing.T) {
+	n := &webhookNotifier{settings: WebhookSettings{
+		URL:    "https://matrix.example/_matrix/client/v3/rooms/!room:example/send/m.room.message/",
+		Preset: WP_Matrix,
+	}}
+	notification := Notification{ID: newNotificationID(), Title: "Backup Job completed!"}
+
+	method, first, _ := n.payload(notification)
+	if method != "PUT" || !strings.HasSuffix(first, "/m.room.message/borgmox"+notification.ID) {
+		t.Fatalf("payload = %v %v", method, first)
+	}
+
+	// A retry must be recognized as the same message
+	time.Sleep(time.Millisecond)
+	if _, retried, _ := n.payload(notification); retried != first {
+		t.Errorf("retry URL = %v, want %v", retried, first)
+	}
+
+	other := notification
+	other.ID = newNotificationID()
+	if _, url, _ := n.payload(other); url == first {
+		t.Errorf("two notifications share the transaction URL %v", url)
+	}
+}
@@ -0,0 +1,220 @@
+package Job
+
+import (
+	"borgmox/BorgCLI"
+	"borgmox/ProxmoxCLI"
+	"fmt"
+	"sort"
+)
+
+// activeArchives tracks, for every repository, the archive prefixes of the VMs/LXCs that are part of a job.
+type activeArchives struct {
+	prefixes map[string]map[string]struct{}
+	// complete is false if some job couldn't read its pools, so its VMs/LXCs are unknown.
+	complete bool
+}
+
+func (s *JobData) newActiveArchives(jobMachines map[string]map[uint64]BackupJobData) activeArchives {
+	active := activeArchives{
+		prefixes: make(map[string]map[string]struct{}),
+		complete: true,
+	}
+
+	for jobName, jobSettings := range s.BackupJobs {
+		machines, ok := jobMachines[jobName]
+		if !ok {
+			active.complete = false
+			continue
+		}
+		for _, repository := range jobSettings.repositories() {
+			if active.prefixes[repository.Repository] == nil {
+				active.prefixes[repository.Repository] = make(map[string]struct{})
+			}
+			for _, machine := range machines {
+				active.prefixes[repository.Repository][machine.archivePrefix()] = struct{}{}
+			}
+		}
+	}
+	return active
+}
+
+type orphanGuest struct {
+	Prefix   string
+	Type     ProxmoxCLI.MachineType
+	VMID     uint64
+	Archives int
+}
+
+// findOrphans lists the archives of this host in a repository, and returns the VMs/LXCs that no job backs up anymore.
+func (s *JobData) findOrphans(repository BorgCLI.BorgSettings, naming archiveNaming, active activeArchives) ([]orphanGuest, error) {
+	archives, err := BorgCLI.ListArchives(repository, naming.listGlob())
+	if err != nil {
+		return nil, err
+	}
+
+	orphans := map[string]*orphanGuest{}
+	for _, archive := range archives {
+		prefix, machineType, vmid, ok := naming.parse(archive)
+		if !ok {
+			continue
+		}
+		if _, ok := active.prefixes[repository.Repository][prefix]; ok {
+			continue
+		}
+		if orphans[prefix] == nil {
+			orphans[prefix] = &orphanGuest{
+				Prefix: prefix,
+				Type:   machineType,
+				VMID:   vmid,
+			}
+		}
+		orphans[prefix].Archives++
+	}
+
+	result := make([]orphanGuest, 0, len(orphans))
+	for _, orphan := range orphans {
+		result = append(result, *orphan)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Prefix < result[j].Prefix
+	})
+	return result, nil
+}
+
+// hasOrphanPass reports whether the job looks for orphaned archives.
+func (js BackupJobSettings) hasOrphanPass() bool {
+	return js.OrphanPolicy != OP_Keep && js.OrphanPolicy != ""
+}
+
+// orphanScanKey identifies the archives of a repository that a job's naming matches.
+// Jobs that share a repository and a naming find the same orphans.
+func orphanScanKey(repository BorgCLI.BorgSettings, naming archiveNaming) string {
+	return repository.Repository + "\x00" + naming.pattern.String()
+}
+
+// orphanScans returns, for each job, the repositories it looks for orphans in.
+// A repository shared by several jobs with the same naming goes to the first of them only,
+// the others are returned in shared, along with the job that handles them.
+func (s *JobData) orphanScans(jobNames []string) (scans map[string][]BorgCLI.BorgSettings, shared map[string]map[string]string) {
+	scans = make(map[string][]BorgCLI.BorgSettings)
+	shared = make(map[string]map[string]string)
+	owners := make(map[string]string)
+
+	for _, jobName := range jobNames {
+		js := s.BackupJobs[jobName]
+		if !js.hasOrphanPass() {
+			continue
+		}
+		naming, err := newArchiveNaming(jobName, js)
+		if err != nil {
+			continue
+		}
+		for _, repository := range js.repositories() {
+			key := orphanScanKey(repository, naming)
+			if owner, ok := owners[key]; ok {
+				if shared[jobName] == nil {
+					shared[jobName] = make(map[string]string)
+				}
+				shared[jobName][repository.Repository] = owner
+				continue
+			}
+			owners[key] = jobName
+			scans[jobName] = append(scans[jobName], repository)
+		}
+	}
+	return scans, shared
+}
+
+// runSharedOrphans applies the OrphanPolicy of the given jobs, looking through each repository once.
+// It returns the orphans by job, a repository shared by several jobs is reported by the first one.
+func (s *JobData) runSharedOrphans(jobNames []string, active activeArchives) map[string][]OrphanResult {
+	results := make(map[string][]OrphanResult)
+	scans, _ := s.orphanScans(jobNames)
+
+	for _, jobName := range jobNames {
+		for _, repository := range scans[jobName] {
+			results[jobName] = append(results[jobName], s.runOrphans(jobName, s.BackupJobs[jobName], repository, active)...)
+		}
+	}
+	return results
+}
+
+// runOrphans applies the job's OrphanPolicy to a repository of the job.
+func (s *JobData) runOrphans(jobName string, js BackupJobSettings, repository BorgCLI.BorgSettings, active activeArchives) []OrphanResult {
+	naming, err := newArchiveNaming(jobName, js)
+	if err != nil {
+		return []OrphanResult{{
+			Repository: repository.Repository,
+			Decision:   OD_Failed,
+			Error:      err,
+		}}
+	}
+
+	orphans, err := s.findOrphans(repository, naming, active)
+	if err != nil {
+		jobLogger(jobName, NPH_Orphans).Error("Cannot look for orphaned archives", "repository", repository.Repository, "error", err)
+		return []OrphanResult{{
+			Repository: repository.Repository,
+			Decision:   OD_Failed,
+			Error:      fmt.Errorf("cannot list archives: %w", err),
+		}}
+	}
+
+	results := []OrphanResult{}
+	for _, orphan := range orphans {
+		result := OrphanResult{
+			Repository: repository.Repository,
+			Prefix:     orphan.Prefix,
+			Type:       orphan.Type,
+			VMID:       orphan.VMID,
+			Archives:   orphan.Archives,
+		}
+
+		switch js.OrphanPolicy {
+		case OP_Report:
+			result.Decision = OD_Reported
+		case OP_Prune:
+			if !active.complete {
+				result.Decision = OD_Reported
+				result.Reason = "not pruned, some job couldn't read its VM pools"
+			} else if !repository.Prune.Enabled {
+				result.Decision = OD_Kept
+				result.Reason = "prune is disabled in this repository"
+			} else if err := s.runOrphanPrune(jobName, orphan, repository, js); isBorgWarning(err) {
+				result.Decision = OD_Pruned
+				result.Warning = err
+			} else if err != nil {
+				result.Decision = OD_Failed
+				result.Error = err
+			} else {
+				result.Decision = OD_Pruned
+			}
+		default:
+			result.Decision = OD_Failed
+			result.Error = fmt.Errorf("invalid orphan policy: %v", string(js.OrphanPolicy))
+		}
+
+		jobLogger(jobName, NPH_Orphans).Info("Orphaned archives", "result", result.String())
+		results = append(results, result)
+	}
+	return results
+}
+
+// runOrphanPrune prunes the archives of an orphaned guest with the job's OrphanPrune keep-policy, see runPrune.
+func (s *JobData) runOrphanPrune(jobName string, orphan orphanGuest, repository BorgCLI.BorgSettings, js BackupJobSettings) error {
+	repository.Prune.BorgKeepSettings = js.OrphanPrune
+
+	logger := jobLogger(jobName, NPH_Orphans).With("vmid", orphan.VMID, "repository", repository.Repository)
+	_, err := s.runPrune(logger, repository, orphan.Prefix)
+	return err
+}
+
+func orphanErrors(orphans []OrphanResult) []OrphanResult {
+	failed := []OrphanResult{}
+	for _, orphan := range orphans {
+		if orphan.Error != nil {
+			failed = append(failed, orphan)
+		}
+	}
+	return failed
+}
@@ -2,46 +2,217 @@ package Job
 
 import (
 	"borgmox/BorgCLI"
-	"log"
-	"os"
+	"errors"
+	"fmt"
+	"log/slog"
 	"os/exec"
+	"slices"
+	"time"
 )
 
-func (s *JobData) runPrune(bjd BackupJobData, js BackupJobSettings) error {
-	archivePrefix := genArchivePrefix(js.ArchivePrefix, bjd.Info)
+// PruneGuardError is returned when a prune was refused by one of the safety guards.
+type PruneGuardError struct {
+	Reason string
+}
+
+func (e *PruneGuardError) Error() string {
+	return "prune refused: " + e.Reason
+}
+
+// PruneSkipError is returned when a repository isn't pruned because the backup of this run failed in it.
+// The failed backup was already reported, so it's not a tripped guard.
+type PruneSkipError struct {
+	Reason string
+}
+
+func (e *PruneSkipError) Error() string {
+	return "prune skipped: " + e.Reason
+}
+
+// hasPruneGuards reports whether the prune of a repository must be previewed before running it.
+func hasPruneGuards(repository BorgCLI.BorgSettings) bool {
+	return repository.Prune.MinRemaining > 0 || repository.Prune.MaxDeletions > 0
+}
+
+// checkPruneGuards compares what a prune would keep and delete against the guards of the repository.
+func checkPruneGuards(repository BorgCLI.BorgSettings, list BorgCLI.PruneList) error {
+	if len(list.Delete) == 0 {
+		return nil
+	}
+	if uint64(len(list.Keep)) < repository.Prune.MinRemaining {
+		return &PruneGuardError{
+			Reason: fmt.Sprintf("only %v archives would remain, at least %v are required", len(list.Keep), repository.Prune.MinRemaining),
+		}
+	}
+	if repository.Prune.MaxDeletions > 0 && uint64(len(list.Delete)) > repository.Prune.MaxDeletions {
+		return &PruneGuardError{
+			Reason: fmt.Sprintf("%v archives would be deleted, at most %v are allowed", len(list.Delete), repository.Prune.MaxDeletions),
+		}
+	}
+	return nil
+}
+
+// pruneGuardErrors returns the prunes that were refused by the guards.
+func pruneGuardErrors(failed map[uint64]error) map[uint64]error {
+	guarded := make(map[uint64]error)
+	for vmid, err := range failed {
+		var guardErr *PruneGuardError
+		if errors.As(err, &guardErr) {
+			guarded[vmid] = err
+		}
+	}
+	return guarded
+}
+
+func sortedErrorKeys(m map[uint64]error) []uint64 {
+	keys := make([]uint64, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// runPrune prunes the archives starting with archivePrefix in a repository, whose keep-policy is already resolved,
+// and returns the archives that were deleted. The guards of the repository are checked first.
+func (s *JobData) runPrune(logger *slog.Logger, repository BorgCLI.BorgSettings, archivePrefix string) ([]string, error) {
 	var cmdRunAll *exec.Cmd
 	var err error
 
-	if cmdRunAll, err = BorgCLI.PruneByPrefix(js.Borg, archivePrefix); err != nil {
-		return err
+	if hasPruneGuards(repository) {
+		list, err := s.listPrune(repository, archivePrefix)
+		if err != nil {
+			return nil, fmt.Errorf("cannot preview the prune: %w", err)
+		}
+		if err := checkPruneGuards(repository, list); err != nil {
+			logger.Warn("Refusing to prune the archives", "error", err)
+			return nil, err
+		}
 	}
 
-	cmdRunAll.Stdout = os.Stdout
-	cmdRunAll.Stderr = os.Stderr
-
-	log.Printf("Now pruning archives for VM/LXC %v (%v)", bjd.Info.Name, bjd.Info.VMID)
-	if err := cmdRunAll.Run(); err != nil {
-		return err
+	if cmdRunAll, err = BorgCLI.PruneByPrefix(repository, archivePrefix); err != nil {
+		return nil, err
 	}
 
-	return nil
+	logger.Info("Now pruning archives")
+	output, err := s.runBorgOutput(logger, cmdRunAll)
+
+	// borg may have deleted some archives before failing
+	return BorgCLI.ParsePruneList(output).Delete, err
+}
+
+// runPrunes prunes the archives of a guest in every repository of the job that has pruning enabled.
+// Repositories where the backup of this run failed are refused.
+func (s *JobData) runPrunes(logger *slog.Logger, pruneData prunableMachine, js BackupJobSettings) (PrunedArchives, error) {
+	pruned := make(PrunedArchives)
+	var errs []error
+	for _, repository := range js.repositories() {
+		if !repository.Prune.Enabled {
+			continue
+		}
+		logger := logger.With("repository", repository.Repository)
+		if backupErr, ok := pruneData.Backups[repository.Repository]; pruneData.BackedUp && (!ok || backupErr != nil) {
+			logger.Warn("Refusing to prune the archives: the backup of this run failed")
+			errs = append(errs, fmt.Errorf("%v: %w", repository.Repository, &PruneSkipError{Reason: "the backup of this run failed"}))
+		} else {
+			deleted, err := s.runPrune(logger, js.pruneSettings(repository, pruneData.Bjd.Info), pruneData.Bjd.archivePrefix())
+			if len(deleted) > 0 {
+				pruned[repository.Repository] = deleted
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%v: %w", repository.Repository, err))
+			}
+		}
+	}
+	return pruned, errors.Join(errs...)
 }
 
-func (s *JobData) runCompact(js BackupJobSettings) error {
+func (s *JobData) runCompact(repository BorgCLI.BorgSettings) error {
 	var cmdRunAll *exec.Cmd
 	var err error
 
-	if cmdRunAll, err = BorgCLI.Compact(js.Borg); err != nil {
+	if cmdRunAll, err = BorgCLI.Compact(repository); err != nil {
 		return err
 	}
 
-	cmdRunAll.Stdout = os.Stdout
-	cmdRunAll.Stderr = os.Stderr
-
-	log.Printf("Now compacting borg repository...")
-	if err := cmdRunAll.Run(); err != nil {
+	logger := jobLogger("", NPH_Compact).With("repository", repository.Repository)
+	logger.Info("Now compacting borg repository")
+	if err := s.runBorg(logger, cmdRunAll); err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// runSharedCompacts compacts every repository of the given jobs once, if it's due.
+// It returns the outcome by repository path; repositories that weren't due are left out.
+func (s *JobData) runSharedCompacts(jobNames []string, state *persistentState, now time.Time) map[string]error {
+	results := make(map[string]error)
+	seen := make(map[string]struct{})
+
+	for _, jobName := range jobNames {
+		for _, repository := range s.BackupJobs[jobName].repositories() {
+			if !repository.Prune.Enabled || !repository.Prune.Compact {
+				continue
+			}
+			if _, ok := seen[repository.Repository]; ok {
+				continue
+			}
+			seen[repository.Repository] = struct{}{}
+
+			last := state.LastCompact[repository.Repository]
+			if !isDue(last, repository.Prune.CompactEveryDays, now) {
+				jobLogger("", NPH_Compact).Info("Skipping the compaction", "repository", repository.Repository, "last_compact", last.Format(time.RFC3339))
+				continue
+			}
+
+			err := s.runCompact(repository)
+			results[repository.Repository] = err
+			if err == nil || isBorgWarning(err) {
+				state.LastCompact[repository.Repository] = now
+			}
+		}
+	}
+	return results
+}
+
+// compactError joins the compact errors of the repositories of the job.
+func (js BackupJobSettings) compactError(results map[string]error) error {
+	var errs []error
+	for _, repository := range js.repositories() {
+		if err := results[repository.Repository]; err != nil {
+			errs = append(errs, fmt.Errorf("%v: %w", repository.Repository, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// compacted reports whether any repository of the job was compacted, compactions that aren't due don't run.
+func (js BackupJobSettings) compacted(results map[string]error) bool {
+	for _, repository := range js.repositories() {
+		if _, ok := results[repository.Repository]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPrune reports whether any repository of the job has pruning enabled.
+func (js BackupJobSettings) hasPrune() bool {
+	for _, repository := range js.repositories() {
+		if repository.Prune.Enabled {
+			return true
+		}
+	}
+	return false
+}
+
+// hasCompact reports whether any repository of the job has both pruning and compacting enabled.
+func (js BackupJobSettings) hasCompact() bool {
+	for _, repository := range js.repositories() {
+		if repository.Prune.Enabled && repository.Prune.Compact {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,286 @@
+package Job
+
+import (
+	"borgmox/BorgCLI"
+	"borgmox/ProxmoxCLI"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// Version of the run report, bumped on incompatible changes
+const reportDocumentVersion = 1
+
+// ReportRepository is the outcome of a backup in one of the repositories of the job.
+type ReportRepository struct {
+	Repository string `json:"repository"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+}
+
+// ReportGuest is a VM/LXC of a job in the run report.
+type ReportGuest struct {
+	VMID uint64 `json:"vmid"`
+	Name string `json:"name,omitempty"`
+	Type string `json:"type"`
+
+	// "succeeded", "partial", "failed", or "skipped" when no backup ran
+	Backup          string             `json:"backup"`
+	Archive         string             `json:"archive,omitempty"`
+	Error           string             `json:"error,omitempty"`
+	Warning         string             `json:"warning,omitempty"`
+	Retries         int                `json:"retries"`
+	DurationSeconds float64            `json:"duration_seconds"`
+	Stats           *WebhookStats      `json:"stats,omitempty"`
+	Repositories    []ReportRepository `json:"repositories,omitempty"`
+
+	// "succeeded", "failed", or "skipped" when no prune ran
+	Prune          string              `json:"prune"`
+	PruneError     string              `json:"prune_error,omitempty"`
+	PruneWarning   string              `json:"prune_warning,omitempty"`
+	PrunedArchives map[string][]string `json:"pruned_archives,omitempty"`
+}
+
+// ReportCheck is the outcome of the repository checks that ran after a job.
+type ReportCheck struct {
+	Error string `json:"error,omitempty"`
+}
+
+// ReportJob is a job in the run report.
+type ReportJob struct {
+	Job                 string          `json:"job"`
+	Outcome             string          `json:"outcome"`
+	Error               string          `json:"error,omitempty"`
+	Guests              []ReportGuest   `json:"guests"`
+	Orphans             []WebhookOrphan `json:"orphans,omitempty"`
+	CompactError        string          `json:"compact_error,omitempty"`
+	CompactWarning      string          `json:"compact_warning,omitempty"`
+	Check               *ReportCheck    `json:"check,omitempty"`
+	FailedNotifications []string        `json:"failed_notifications,omitempty"`
+}
+
+// ReportCompaction is the compaction of a repository, shared by every job that prunes it.
+type ReportCompaction struct {
+	Repository string `json:"repository"`
+	// "succeeded", "warning" or "failed"
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// RunReport is the JSON document written to the ReportFile at the end of a run.
+type RunReport struct {
+	Version        int                `json:"version"`
+	RunID          string             `json:"run_id"`
+	Host           string             `json:"host"`
+	Started        time.Time          `json:"started"`
+	Finished       time.Time          `json:"finished"`
+	BorgmoxVersion string             `json:"borgmox_version"`
+	BorgVersion    string             `json:"borg_version,omitempty"`
+	PveVersion     string             `json:"pve_version,omitempty"`
+	Outcome        string             `json:"outcome"`
+	Jobs           []ReportJob        `json:"jobs"`
+	Compactions    []ReportCompaction `json:"compactions,omitempty"`
+	// Undelivered notifications that belong to no job, i.e. the digest
+	FailedNotifications []string `json:"failed_notifications,omitempty"`
+}
+
+// reportGuest builds the report of a VM/LXC of the job.
+func (r JobResult) reportGuest(info ProxmoxCLI.MachineInfo) ReportGuest {
+	vmid := info.VMID
+	guest := ReportGuest{
+		VMID:    vmid,
+		Name:    info.Name,
+		Type:    machineTypeName(info.Type),
+		Backup:  "skipped",
+		Warning: errorString(r.BackupWarnings[vmid]),
+		Prune:   "skipped",
+	}
+
+	if err, ok := r.FailedBackups[vmid]; ok {
+		guest.Backup = "failed"
+		guest.Error = errorString(err)
+	} else if _, ok := r.SucceededBackups[vmid]; ok {
+		guest.Backup = "succeeded"
+		if err, ok := r.FailedReplicaBackups[vmid]; ok {
+			guest.Backup = "partial"
+			guest.Error = errorString(err)
+		}
+	}
+	if attempts := r.BackupAttempts[vmid]; attempts > 1 {
+		guest.Retries = attempts - 1
+	}
+	guest.DurationSeconds = r.BackupDurations[vmid].Seconds()
+	if stats, ok := r.BackupStats[vmid]; ok {
+		guest.Archive = stats.Archive
+		if stats.Bytes > 0 {
+			guest.Stats = webhookStats(stats)
+		}
+	}
+
+	results := r.RepositoryBackups[vmid]
+	repositories := make([]string, 0, len(results))
+	for repository := range results {
+		repositories = append(repositories, repository)
+	}
+	slices.Sort(repositories)
+	for _, repository := range repositories {
+		status := "succeeded"
+		if results[repository] != nil {
+			status = "failed"
+		}
+		guest.Repositories = append(guest.Repositories, ReportRepository{
+			Repository: repository,
+			Status:     status,
+			Error:      errorString(results[repository]),
+		})
+	}
+
+	if err, ok := r.FailedPrunes[vmid]; ok {
+		guest.Prune = "failed"
+		guest.PruneError = errorString(err)
+	} else if _, ok := r.SucceededPrunes[vmid]; ok {
+		guest.Prune = "succeeded"
+		guest.PruneWarning = errorString(r.PruneWarnings[vmid])
+	}
+	guest.PrunedArchives = r.PrunedArchives[vmid]
+
+	return guest
+}
+
+// reportJob builds the report of a job.
+func (r JobResult) reportJob(jobName string) ReportJob {
+	job := ReportJob{
+		Job:            jobName,
+		Outcome:        string(r.digestJob(jobName).Outcome),
+		Error:          errorString(r.Error),
+		Guests:         []ReportGuest{},
+		CompactError:   errorString(r.FailedCompact),
+		CompactWarning: errorString(r.CompactWarning),
+	}
+
+	vmids := make([]uint64, 0, len(r.Machines))
+	for vmid := range r.Machines {
+		vmids = append(vmids, vmid)
+	}
+	slices.Sort(vmids)
+	for _, vmid := range vmids {
+		job.Guests = append(job.Guests, r.reportGuest(r.Machines[vmid]))
+	}
+
+	for _, orphan := range r.Orphans {
+		job.Orphans = append(job.Orphans, webhookOrphan(orphan))
+	}
+
+	if r.CheckRan {
+		job.Check = &ReportCheck{Error: errorString(r.FailedCheck)}
+	}
+	for _, err := range r.FailedNotifications {
+		job.FailedNotifications = append(job.FailedNotifications, err.Error())
+	}
+
+	return job
+}
+
+// newRunReport builds the report of a run, from the results of its jobs and of its compactions.
+func (s *JobData) newRunReport(results map[string]JobResult) RunReport {
+	hostname, _ := os.Hostname()
+	report := RunReport{
+		Version:        reportDocumentVersion,
+		RunID:          s.runID,
+		Host:           hostname,
+		Started:        s.runStarted.UTC(),
+		Finished:       time.Now().UTC(),
+		BorgmoxVersion: BorgmoxVersion,
+		Outcome:        string(NO_Success),
+		Jobs:           []ReportJob{},
+	}
+	if borgVersion, err := BorgCLI.GetVersion(); err == nil {
+		report.BorgVersion = borgVersion.Original()
+	}
+	if pveVersion, err := ProxmoxCLI.GetVersion(); err == nil {
+		report.PveVersion = pveVersion.Original()
+	}
+
+	for _, jobName := range sortedJobNames(s.BackupJobs) {
+		result, ok := results[jobName]
+		if !ok {
+			continue
+		}
+		job := result.reportJob(jobName)
+		report.Outcome = string(worseOutcome(NotificationOutcome(report.Outcome), NotificationOutcome(job.Outcome)))
+		report.Jobs = append(report.Jobs, job)
+	}
+
+	repositories := make([]string, 0, len(s.compactResults))
+	for repository := range s.compactResults {
+		repositories = append(repositories, repository)
+	}
+	slices.Sort(repositories)
+	for _, repository := range repositories {
+		compaction := ReportCompaction{
+			Repository: repository,
+			Status:     "succeeded",
+			Error:      errorString(s.compactResults[repository]),
+		}
+		if isBorgWarning(s.compactResults[repository]) {
+			compaction.Status = "warning"
+		} else if s.compactResults[repository] != nil {
+			compaction.Status = "failed"
+		}
+		report.Compactions = append(report.Compactions, compaction)
+	}
+
+	for _, err := range s.failedNotifications {
+		report.FailedNotifications = append(report.FailedNotifications, err.Error())
+	}
+
+	return report
+}
+
+// writeReport writes the report of the run to path.
+func (s *JobData) writeReport(path string, report RunReport) error {
+	data, err := json.MarshalIndent(report, "", "\t")
+	if err != nil {
+		return fmt.Errorf("couldn't encode the run report: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("couldn't create the run report directory: %w", err)
+	}
+
+	// Readers never see a half-written report
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("couldn't write run report %v: %w", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("couldn't replace run report %v: %w", path, err)
+	}
+	return nil
+}
+
+// reportFile returns where the report of the run goes, --report-file first, or "" when there's no report.
+func (s *JobData) reportFile(options JobOptions) string {
+	if options.ReportFile != "" {
+		return options.ReportFile
+	}
+	return s.ReportFile
+}
+
+// WriteReport writes the report of the run that returned results, if there's a ReportFile.
+// It goes after SendDigest, so that an undelivered digest is in the report.
+func (s *JobData) WriteReport(options JobOptions, results map[string]JobResult) {
+	path := s.reportFile(options)
+	if path == "" {
+		return
+	}
+	if err := s.writeReport(path, s.newRunReport(results)); err != nil {
+		slog.Error("Cannot write the run report", "error", err)
+		return
+	}
+	slog.Info("Run report written", "path", path)
+}
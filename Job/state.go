@@ -0,0 +1,85 @@
+package Job
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const DefaultStateDirectory = "/var/lib/borgmox"
+const stateFileName = "state.json"
+
+// persistentState holds what borgmox must remember between two runs.
+// Repositories are identified by their borg repository path.
+type persistentState struct {
+	LastCheck   map[string]time.Time
+	LastCompact map[string]time.Time
+
+	path string
+}
+
+func (s *JobData) stateDirectory() string {
+	if s.StateDirectory == "" {
+		return DefaultStateDirectory
+	}
+	return s.StateDirectory
+}
+
+func (s *JobData) loadState() (*persistentState, error) {
+	state := &persistentState{
+		path: filepath.Join(s.stateDirectory(), stateFileName),
+	}
+
+	if data, err := os.ReadFile(state.path); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return state.init(), fmt.Errorf("couldn't read state file %v: %w", state.path, err)
+		}
+	} else if err := json.Unmarshal(data, state); err != nil {
+		return state.init(), fmt.Errorf("couldn't decode state file %v: %w", state.path, err)
+	}
+
+	return state.init(), nil
+}
+
+func (st *persistentState) init() *persistentState {
+	if st.LastCheck == nil {
+		st.LastCheck = make(map[string]time.Time)
+	}
+	if st.LastCompact == nil {
+		st.LastCompact = make(map[string]time.Time)
+	}
+	return st
+}
+
+func (st *persistentState) save() error {
+	if err := os.MkdirAll(filepath.Dir(st.path), 0700); err != nil {
+		return fmt.Errorf("couldn't create state directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(st, "", "\t")
+	if err != nil {
+		return fmt.Errorf("couldn't encode state: %w", err)
+	}
+
+	// Write to a temporary file first, so that a crash can't leave a truncated state behind
+	tmpPath := st.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("couldn't write state file %v: %w", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, st.path); err != nil {
+		return fmt.Errorf("couldn't replace state file %v: %w", st.path, err)
+	}
+	return nil
+}
+
+// isDue reports whether an operation last run at "last" should run again, given an interval in days.
+func isDue(last time.Time, everyDays uint64, now time.Time) bool {
+	if everyDays == 0 || last.IsZero() {
+		return true
+	}
+	// Allow for some slack, so that a timer firing slightly earlier than the previous day doesn't skip a cycle
+	return now.Sub(last) >= time.Duration(everyDays)*24*time.Hour-time.Hour
+}
@@ -3,6 +3,10 @@ package Job
 import (
 	"borgmox/BorgCLI"
 	"borgmox/ProxmoxCLI"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
 )
 
 type VMBackupMode string
@@ -14,6 +18,20 @@ const (
 	LXCBKP_Image LXCBackupMode = "image"
 )
 
+type OrphanPolicy string
+type OrphanDecision string
+
+const (
+	OP_Keep   OrphanPolicy = "keep"
+	OP_Prune  OrphanPolicy = "prune"
+	OP_Report OrphanPolicy = "report"
+
+	OD_Kept     OrphanDecision = "kept"
+	OD_Pruned   OrphanDecision = "pruned"
+	OD_Reported OrphanDecision = "reported"
+	OD_Failed   OrphanDecision = "failed"
+)
+
 type NotificationFrequency string
 type NotificationPriority string
 
@@ -37,38 +55,343 @@ type NotificationTargetInfo struct {
 	FailurePriority    NotificationPriority
 	SuccessEmailTarget string
 	FailureEmailTarget string
+
+	// ntfy only: tags added to the outcome, phase and job tags
+	Tags []string
+	// ntfy only: render the message as Markdown
+	Markdown bool
+	// ntfy only: attach the vzdump/borg output of the failed VMs/LXCs
+	AttachLog bool
+	// ntfy only: URL opened by tapping the notification, and action buttons in the ntfy "Actions" format
+	Click   string
+	Actions string
 }
 
-type NotificationSettings struct {
+func (n NotificationTargetInfo) isEnabled() bool {
+	return n.Frequency == NF_EveryVmFinished || n.Frequency == NF_EntireJobFinished
+}
+
+// NotificationTargets routes the events of a job by phase.
+type NotificationTargets struct {
 	BackupTargetInfo NotificationTargetInfo
 	PruneTargetInfo  NotificationTargetInfo
+	CheckTargetInfo  NotificationTargetInfo
+}
+
+// NotificationTemplates are text/template overrides of the title and message, executed against NotificationData.
+type NotificationTemplates struct {
+	TitleTemplate string
+	BodyTemplate  string
+}
 
+// NotificationSettings routes the events of a job to its ntfy server, the "Notification" group.
+type NotificationSettings struct {
+	NotificationTargets
+	NotificationTemplates
+	NtfySettings
+}
+
+type NtfySettings struct {
 	TargetServer string
 	AuthUser     string
 	AuthPassword string
 	Topic        string
 }
 
+// NotifierBackend is a notifier of Type, whose settings are in the table named after it.
+type NotifierBackend struct {
+	Type NotifierType
+	NotificationTemplates
+	Ntfy    *NtfySettings
+	Smtp    *SmtpSettings
+	Webhook *WebhookSettings
+}
+
+// NotifierSettings is an entry of the Notifications list of a job.
+type NotifierSettings struct {
+	NotifierBackend
+	NotificationTargets
+}
+
 type BackupJobData struct {
-	Info ProxmoxCLI.MachineInfo
+	Info   ProxmoxCLI.MachineInfo
+	naming archiveNaming
 }
 
 type BackupJobSettings struct {
-	ArchivePrefix string
-	VmPool        []string
-	VmMode        VMBackupMode
-	LxcMode       LXCBackupMode
-	Notification  NotificationSettings
-	Borg          BorgCLI.BorgSettings
+	ArchivePrefix       string
+	ArchiveNameTemplate string
+	ArchiveTimezone     string
+	VmPool              []string
+	VmMode              VMBackupMode
+	LxcMode             LXCBackupMode
+	Notification        NotificationSettings
+	Notifications       []NotifierSettings
+	Heartbeat           HeartbeatSettings
+	Borg                BorgCLI.BorgSettings
+	Replicas            []BorgCLI.BorgSettings
+	OrphanPolicy        OrphanPolicy
+	OrphanPrune         BorgCLI.BorgKeepSettings
+	PruneOverrides      []PruneOverride
+	// The newest backup of every VM/LXC must be younger than this, see "borgmox audit".
+	// A Go duration or a number of days, i.e. "26h" or "2d"; empty to only report missing backups
+	MaxAge string
+}
+
+// PruneOverride replaces the keep-policy of every repository for the VMs/LXCs it matches.
+type PruneOverride struct {
+	VMIDs []uint64
+	Tags  []string
+	BorgCLI.BorgKeepSettings
+}
+
+func (o PruneOverride) matches(info ProxmoxCLI.MachineInfo) bool {
+	if slices.Contains(o.VMIDs, info.VMID) {
+		return true
+	}
+	for _, tag := range info.TagList() {
+		if slices.Contains(o.Tags, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// pruneSettings returns the repository settings with the keep-policy that applies to a VM/LXC.
+// VMID overrides win over tag overrides, then the first matching override wins.
+func (js BackupJobSettings) pruneSettings(repository BorgCLI.BorgSettings, info ProxmoxCLI.MachineInfo) BorgCLI.BorgSettings {
+	for _, override := range js.PruneOverrides {
+		if slices.Contains(override.VMIDs, info.VMID) {
+			repository.Prune.BorgKeepSettings = override.BorgKeepSettings
+			return repository
+		}
+	}
+	for _, override := range js.PruneOverrides {
+		if override.matches(info) {
+			repository.Prune.BorgKeepSettings = override.BorgKeepSettings
+			return repository
+		}
+	}
+	return repository
+}
+
+func (js BackupJobSettings) hasTagOverrides() bool {
+	for _, override := range js.PruneOverrides {
+		if len(override.Tags) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// repositories returns the primary repository, followed by its replicas.
+func (js BackupJobSettings) repositories() []BorgCLI.BorgSettings {
+	return append([]BorgCLI.BorgSettings{js.Borg}, js.Replicas...)
+}
+
+// RepositoryResults holds the outcome of an operation for each repository, nil on success.
+type RepositoryResults map[string]error
+
+func (r RepositoryResults) failAll(repositories []BorgCLI.BorgSettings, err error) RepositoryResults {
+	for _, repository := range repositories {
+		if r[repository.Repository] == nil {
+			r[repository.Repository] = err
+		}
+	}
+	return r
+}
+
+// PrunedArchives are the archives deleted by a prune, by repository path.
+type PrunedArchives map[string][]string
+
+// replicaError joins the errors of all repositories but the primary one.
+func (r RepositoryResults) replicaError(primary string) error {
+	var errs []error
+	for repository, err := range r {
+		if repository != primary && err != nil {
+			errs = append(errs, fmt.Errorf("%v: %w", repository, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// locked reports whether every repository failed because borg couldn't lock it.
+// borg takes the lock before it reads the dump, so none of these archives was started.
+func (r RepositoryResults) locked() bool {
+	for _, err := range r {
+		if !errors.Is(err, BorgCLI.ErrLockTimeout) && !errors.Is(err, BorgCLI.ErrLockFailed) {
+			return false
+		}
+	}
+	return len(r) > 0
+}
+
+// takeWarnings removes the repositories that only logged borg warnings from the results, they received their archive.
+// It returns those warnings, or nil.
+func (r RepositoryResults) takeWarnings() error {
+	repositories := make([]string, 0, len(r))
+	for repository := range r {
+		repositories = append(repositories, repository)
+	}
+	slices.Sort(repositories)
+
+	var warnings []error
+	for _, repository := range repositories {
+		if isBorgWarning(r[repository]) {
+			warnings = append(warnings, fmt.Errorf("%v: %w", repository, r[repository]))
+			r[repository] = nil
+		}
+	}
+	return errors.Join(warnings...)
+}
+
+// isBorgWarning reports whether err, and every error it joins, is a borg exit code 1:
+// the command did its work, only logging warnings.
+func isBorgWarning(err error) bool {
+	switch e := err.(type) {
+	case *BorgCLI.Error:
+		return e.IsWarning()
+	case interface{ Unwrap() []error }:
+		for _, joined := range e.Unwrap() {
+			if !isBorgWarning(joined) {
+				return false
+			}
+		}
+		return len(e.Unwrap()) > 0
+	case interface{ Unwrap() error }:
+		return isBorgWarning(e.Unwrap())
+	}
+	return false
+}
+
+// StreamStats describes the vzdump stream of a single backup.
+type StreamStats struct {
+	// The archive that was created, or that the backup tried to create
+	Archive  string
+	Bytes    uint64
+	Duration time.Duration
+	SHA256   string
+	// What the archive added to the primary repository, after deduplication and compression
+	Deduplicated uint64
+}
+
+// Throughput returns the average speed of the stream, in bytes per second.
+func (s StreamStats) Throughput() float64 {
+	if s.Duration <= 0 {
+		return 0
+	}
+	return float64(s.Bytes) / s.Duration.Seconds()
+}
+
+// OrphanResult describes what happened to the archives of a VM/LXC that's no longer part of any job.
+type OrphanResult struct {
+	Repository string
+	Prefix     string
+	Type       ProxmoxCLI.MachineType
+	VMID       uint64
+	Archives   int
+	Decision   OrphanDecision
+	Reason     string
+	Error      error
+	// borg warnings of a prune that still went through
+	Warning error
+}
+
+func (o OrphanResult) String() string {
+	str := fmt.Sprintf("%v %v in %v: %v archives %v", machineTypeName(o.Type), o.VMID, o.Repository, o.Archives, string(o.Decision))
+	if o.Reason != "" {
+		str += " (" + o.Reason + ")"
+	}
+	if o.Error != nil {
+		str += " (" + o.Error.Error() + ")"
+	}
+	if o.Warning != nil {
+		str += " (warning: " + o.Warning.Error() + ")"
+	}
+	return str
 }
 
 type JobResult struct {
-	Error            error
-	SucceededBackups map[uint64]struct{}
-	FailedBackups    map[uint64]error
-	SucceededPrunes  map[uint64]struct{}
-	FailedPrunes     map[uint64]error
-	FailedCompact    error
+	Error                error
+	Machines             map[uint64]ProxmoxCLI.MachineInfo
+	SucceededBackups     map[uint64]struct{}
+	FailedBackups        map[uint64]error
+	FailedReplicaBackups map[uint64]error
+	RepositoryBackups    map[uint64]RepositoryResults
+	BackupStats          map[uint64]StreamStats
+	// How many times the backup ran, see backupAttempts, and how long it took overall
+	BackupAttempts  map[uint64]int
+	BackupDurations map[uint64]time.Duration
+	// The vzdump/borg output of the VMs/LXCs whose backup failed, even partially
+	BackupLogs      map[uint64]string
+	SucceededPrunes map[uint64]struct{}
+	FailedPrunes    map[uint64]error
+	PrunedArchives  map[uint64]PrunedArchives
+	// The prune overrides referring to VMIDs that aren't part of the job, see staleOverrides
+	StaleOverrides error
+	Orphans        []OrphanResult
+	// Whether a repository of the job was compacted, compactions that aren't due are skipped
+	CompactRan    bool
+	FailedCompact error
+	// borg warnings of the backups, prunes and compactions that still succeeded, see isBorgWarning
+	BackupWarnings      map[uint64]error
+	PruneWarnings       map[uint64]error
+	CompactWarning      error
+	CheckRan            bool
+	FailedCheck         error
+	SucceededChecks     []string
+	AuditRan            bool
+	FailedAudit         map[uint64]error
+	FailedNotifications []error
+}
+
+// IsPartial reports whether the primary repository received every backup, but some replicas didn't.
+func (r JobResult) IsPartial() bool {
+	return r.Error == nil && len(r.FailedBackups) == 0 && len(r.FailedReplicaBackups) > 0
+}
+
+// HasWarnings reports whether borg logged warnings during a backup, prune or compaction that otherwise succeeded.
+func (r JobResult) HasWarnings() bool {
+	for _, orphan := range r.Orphans {
+		if orphan.Warning != nil {
+			return true
+		}
+	}
+	return len(r.BackupWarnings) > 0 || len(r.PruneWarnings) > 0 || r.CompactWarning != nil
+}
+
+// Failures returns every error of the job, replicas and notifications left out.
+func (r JobResult) Failures() []error {
+	errs := []error{}
+	if r.Error != nil {
+		errs = append(errs, r.Error)
+	}
+	for _, vmid := range sortedErrorKeys(r.FailedBackups) {
+		errs = append(errs, r.FailedBackups[vmid])
+	}
+	for _, vmid := range sortedErrorKeys(r.FailedPrunes) {
+		errs = append(errs, r.FailedPrunes[vmid])
+	}
+	for _, orphan := range orphanErrors(r.Orphans) {
+		errs = append(errs, orphan.Error)
+	}
+	if r.FailedCompact != nil {
+		errs = append(errs, r.FailedCompact)
+	}
+	if r.FailedCheck != nil {
+		errs = append(errs, r.FailedCheck)
+	}
+	for _, vmid := range sortedErrorKeys(r.FailedAudit) {
+		errs = append(errs, r.FailedAudit[vmid])
+	}
+	return errs
+}
+
+// Succeeded reports whether any backup, prune or repository check of the job went through,
+// or whether the audit found any VM/LXC with a recent enough backup.
+func (r JobResult) Succeeded() bool {
+	return len(r.SucceededBackups) > 0 || len(r.SucceededPrunes) > 0 || len(r.SucceededChecks) > 0 ||
+		(r.AuditRan && len(r.Machines) > len(r.FailedAudit))
 }
 
 type JobConfigurations struct {
@@ -78,4 +401,24 @@ type JobConfigurations struct {
 type JobOptions struct {
 	DontBackup bool
 	DontPrune  bool
+	DontCheck  bool
+	DryRun     bool
+	// Overrides JobData.ReportFile
+	ReportFile string
+}
+
+type CheckOptions struct {
+	Jobs  []string
+	Force bool
+}
+
+type InitRepoOptions struct {
+	Repository    string
+	Encryption    BorgCLI.EncryptionMode
+	KeyExportPath string
+	PaperKey      bool
+}
+
+type AuditOptions struct {
+	Jobs []string
 }
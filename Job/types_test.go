@@ -0,0 +1,38 @@
+package Job
+
+import (
+	"borgmox/BorgCLI"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestIsBorgWarning(t *testing.T) {
+	warning := &BorgCLI.Error{ExitCode: 1, Warnings: []string{"file changed while we backed it up"}}
+	failure := &BorgCLI.Error{ExitCode: 2, MsgID: BorgCLI.MSG_LockTimeout, Message: "Failed to create/acquire the lock"}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "success", err: nil, want: false},
+		{name: "warning", err: warning, want: true},
+		{name: "wrapped warning", err: fmt.Errorf("/repo: %w", warning), want: true},
+		{name: "failure", err: failure, want: false},
+		{name: "exit code 1 with an error", err: &BorgCLI.Error{ExitCode: 1, MsgID: BorgCLI.MSG_ArchiveAlreadyExists}, want: false},
+		{name: "ssh failure", err: &BorgCLI.Error{ExitCode: 255, Message: "Connection closed by remote host"}, want: false},
+		{name: "not borg", err: errors.New("vzdump failed"), want: false},
+		{name: "joined warnings", err: errors.Join(fmt.Errorf("/repo: %w", warning), fmt.Errorf("/mnt/replica: %w", warning)), want: true},
+		{name: "warning joined with a failure", err: errors.Join(warning, failure), want: false},
+		{name: "warning joined with a skipped prune", err: errors.Join(warning, &PruneSkipError{Reason: "the backup of this run failed"}), want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isBorgWarning(test.err); got != test.want {
+				t.Errorf("isBorgWarning(%v) = %v, want %v", test.err, got, test.want)
+			}
+		})
+	}
+}
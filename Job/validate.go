@@ -0,0 +1,119 @@
+package Job
+
+import (
+	"borgmox/BorgCLI"
+	"errors"
+	"fmt"
+)
+
+// Validate looks for configuration mistakes that can be found without contacting PVE or borg.
+func (s *JobData) Validate() error {
+	var errs []error
+
+	// Compaction runs once per repository, so every job must agree on how
+	compactOwners := make(map[string]string)
+	compactSettings := make(map[string]BorgCLI.BorgPruneSettings)
+	// Orphans are looked for once per repository and naming, see orphanScans
+	orphanOwners := make(map[string]string)
+
+	if err := s.Heartbeat.validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	for i, notifier := range s.Digest.Notifications {
+		if _, err := newNotifier(notifier); err != nil {
+			errs = append(errs, fmt.Errorf("digest: notification #%v: %w", i+1, err))
+		} else if err := notifier.validateTemplates(); err != nil {
+			errs = append(errs, fmt.Errorf("digest: notification #%v: %w", i+1, err))
+		}
+	}
+
+	for _, jobName := range sortedJobNames(s.BackupJobs) {
+		js := s.BackupJobs[jobName]
+
+		if err := js.Heartbeat.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("backup job %v: %w", jobName, err))
+		}
+
+		if _, err := parseMaxAge(js.MaxAge); err != nil {
+			errs = append(errs, fmt.Errorf("backup job %v: %w", jobName, err))
+		}
+
+		naming, err := newArchiveNaming(jobName, js)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("backup job %v: %w", jobName, err))
+		}
+
+		switch js.OrphanPolicy {
+		case OP_Keep, OP_Report, OP_Prune, "":
+		default:
+			errs = append(errs, fmt.Errorf("backup job %v: invalid orphan policy %q, must be %v, %v or %v", jobName, string(js.OrphanPolicy), OP_Keep, OP_Report, OP_Prune))
+		}
+		if js.OrphanPolicy == OP_Prune && js.OrphanPrune.IsEmpty() {
+			errs = append(errs, fmt.Errorf("backup job %v: orphan policy %v needs OrphanPrune Keep rules", jobName, OP_Prune))
+		}
+		if js.hasOrphanPass() && err == nil {
+			for _, repository := range js.repositories() {
+				key := orphanScanKey(repository, naming)
+				if owner, ok := orphanOwners[key]; !ok {
+					orphanOwners[key] = jobName
+				} else if other := s.BackupJobs[owner]; other.OrphanPolicy != js.OrphanPolicy || other.OrphanPrune != js.OrphanPrune {
+					errs = append(errs, fmt.Errorf("backup job %v: orphan settings of %v differ from backup job %v, which names its archives the same", jobName, repository.Repository, owner))
+				}
+			}
+		}
+
+		if err := js.Notification.validateTemplates(); err != nil {
+			errs = append(errs, fmt.Errorf("backup job %v: notification: %w", jobName, err))
+		}
+		for i, notifier := range js.Notifications {
+			if _, err := newNotifier(notifier.NotifierBackend); err != nil {
+				errs = append(errs, fmt.Errorf("backup job %v: notification #%v: %w", jobName, i+1, err))
+			} else if err := notifier.validateTemplates(); err != nil {
+				errs = append(errs, fmt.Errorf("backup job %v: notification #%v: %w", jobName, i+1, err))
+			}
+		}
+
+		for _, repository := range js.repositories() {
+			if !repository.Prune.Enabled || !repository.Prune.Compact {
+				continue
+			}
+			if repository.Prune.CompactThreshold > 100 {
+				errs = append(errs, fmt.Errorf("backup job %v: compact threshold of %v must be between 0 and 100", jobName, repository.Prune.CompactThreshold))
+			}
+			if owner, ok := compactOwners[repository.Repository]; !ok {
+				compactOwners[repository.Repository] = jobName
+				compactSettings[repository.Repository] = repository.Prune
+			} else if other := compactSettings[repository.Repository]; other.CompactThreshold != repository.Prune.CompactThreshold || other.CompactEveryDays != repository.Prune.CompactEveryDays {
+				errs = append(errs, fmt.Errorf("backup job %v: compact settings of %v differ from backup job %v", jobName, repository.Repository, owner))
+			}
+		}
+
+		for i, override := range js.PruneOverrides {
+			if len(override.VMIDs) == 0 && len(override.Tags) == 0 {
+				errs = append(errs, fmt.Errorf("backup job %v: prune override #%v has no VMIDs or Tags", jobName, i+1))
+			}
+			if override.IsEmpty() {
+				errs = append(errs, fmt.Errorf("backup job %v: prune override #%v has no Keep rules", jobName, i+1))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// staleOverrides returns the VMIDs of the prune overrides that aren't part of the job, i.e. a deleted guest.
+// They only need cleaning up, the other overrides still apply.
+func (js BackupJobSettings) staleOverrides(jobName string, machines map[uint64]BackupJobData) error {
+	var errs []error
+
+	for i, override := range js.PruneOverrides {
+		for _, vmid := range override.VMIDs {
+			if _, ok := machines[vmid]; !ok {
+				errs = append(errs, fmt.Errorf("prune override #%v of Backup Job %v refers to VMID %v, which is not part of the job", i+1, jobName, vmid))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
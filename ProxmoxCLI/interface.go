@@ -1,12 +1,20 @@
 package ProxmoxCLI
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	gv "github.com/hashicorp/go-version"
 )
@@ -15,6 +23,7 @@ type MachineType string
 type MachineStatus string
 type BackupMode string
 type BackupCompression string
+type NotifySeverity string
 
 type BackupAcceptor func(*io.PipeReader) error
 
@@ -34,6 +43,11 @@ const (
 	Snapshot BackupMode = "snapshot"
 	Stop     BackupMode = "stop"
 	Suspend  BackupMode = "suspend"
+
+	NotifyInfo    NotifySeverity = "info"
+	NotifyNotice  NotifySeverity = "notice"
+	NotifyWarning NotifySeverity = "warning"
+	NotifyError   NotifySeverity = "error"
 )
 
 type MachineInfo struct {
@@ -43,6 +57,14 @@ type MachineInfo struct {
 	Name   string        `json:"name,omitempty"`
 	Node   string        `json:"node,omitempty"`
 	Status MachineStatus `json:"status,omitempty"`
+	Tags   string        `json:"tags,omitempty"`
+}
+
+// TagList splits the PVE tags of the machine.
+func (m MachineInfo) TagList() []string {
+	return strings.FieldsFunc(m.Tags, func(r rune) bool {
+		return r == ';' || r == ',' || r == ' '
+	})
 }
 
 type GetMachinesByPoolInfo struct {
@@ -71,6 +93,21 @@ func GetMachinesByPool(Pool string) ([]MachineInfo, error) {
 	}
 }
 
+// GetClusterMachines lists all VMs and LXCs of the cluster, including their tags.
+func GetClusterMachines() ([]MachineInfo, error) {
+	cmd := exec.Command("pvesh", "get", "/cluster/resources", "--type", "vm", "--output-format=json")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("pvesh returned an error: %w", err)
+	} else {
+		data := []MachineInfo{}
+		if err = json.Unmarshal(output, &data); err != nil {
+			return nil, fmt.Errorf("json decoding of pvesh data returned an error: %w", err)
+		} else {
+			return data, nil
+		}
+	}
+}
+
 var regexPveVersion *regexp.Regexp
 
 func GetVersion() (*gv.Version, error) {
@@ -115,3 +152,181 @@ func StartImageBackup(VMID uint64, Settings StartImageBackupSettings) (*exec.Cmd
 
 	return cmd, nil
 }
+
+// How long vzdump gets to clean up after being asked to stop, before it's killed
+const producerStopTimeout = 2 * time.Minute
+
+// ProducerError reports a failure of the process that produces the backup stream.
+type ProducerError struct {
+	Err error
+}
+
+func (e *ProducerError) Error() string {
+	return "vzdump failed: " + e.Err.Error()
+}
+
+func (e *ProducerError) Unwrap() error {
+	return e.Err
+}
+
+// StreamImageBackup runs a backup process created by StartImageBackup, and hands its output to the acceptor.
+// The stream only ends with io.EOF if the backup process succeeded; otherwise, reading fails with a *ProducerError.
+// If the acceptor fails, the backup process is stopped and the acceptor's error is returned.
+// It's asked to stop with SIGTERM first: a killed vzdump leaves its lock on the guest, and its snapshot behind.
+func StreamImageBackup(cmd *exec.Cmd, acceptor BackupAcceptor) error {
+	pr, pw := io.Pipe()
+	cmd.Stdout = pw
+
+	if err := cmd.Start(); err != nil {
+		return &ProducerError{Err: err}
+	}
+
+	producerResult := make(chan error, 1)
+	go func() {
+		var err error
+		if waitErr := cmd.Wait(); waitErr != nil {
+			err = &ProducerError{Err: waitErr}
+		}
+		// A nil error is delivered to the reader as io.EOF
+		pw.CloseWithError(err)
+		producerResult <- err
+	}()
+
+	acceptorErr := acceptor(pr)
+	if acceptorErr == nil {
+		pr.Close()
+		return <-producerResult
+	}
+
+	// Nobody is reading anymore, the writes of the backup process fail from now on
+	pr.CloseWithError(acceptorErr)
+	cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-producerResult:
+		return acceptorErr
+	case <-time.After(producerStopTimeout):
+		cmd.Process.Kill()
+		<-producerResult
+		return fmt.Errorf("%w (vzdump didn't stop within %v and was killed, the guest may need to be unlocked with qm unlock or pct unlock)", acceptorErr, producerStopTimeout)
+	}
+}
+
+// PVE::Notify::notify is called with one of two signatures, those of the pve-manager releases borgmox was written against:
+//   - 8.1 and 8.2: notify($severity, $title_template, $message_template, $data, $fields)
+//   - 8.3 and 8.4: notify($severity, $template_name, $data, $fields), the named templates being read from
+//     /etc/pve/notification-templates/default, next to the overrides of the built-in ones.
+//
+// PVE::Notify isn't a stable API: newer releases are tried with the 8.3 signature, and a mismatch is reported as such.
+const (
+	notifyTemplateName    = "borgmox"
+	notifyTemplateDir     = "/etc/pve/notification-templates/default"
+	notifyTitleTemplate   = "{{ title }}"
+	notifyMessageTemplate = "{{ message }}"
+
+	notifyTimeout = 30 * time.Second
+
+	// Exit codes of notifyScript
+	notifyMissing = 3
+	notifyFailed  = 4
+)
+
+const notifyScript = `
+use strict;
+use warnings;
+use JSON;
+use PVE::INotify;
+use PVE::Notify;
+
+my $n = decode_json(do { local $/; <STDIN> });
+my $data = { title => $n->{title}, message => $n->{message} };
+my $fields = $n->{fields};
+$fields->{hostname} //= PVE::INotify::nodename();
+
+if (!defined(&PVE::Notify::notify)) {
+    print STDERR "PVE::Notify::notify doesn't exist\n";
+    exit 3;
+}
+
+eval {
+    if ($n->{template}) {
+        PVE::Notify::notify($n->{severity}, $n->{template}, $data, $fields);
+    } else {
+        PVE::Notify::notify($n->{severity}, $n->{title_template}, $n->{message_template}, $data, $fields);
+    }
+};
+if ($@) {
+    print STDERR $@;
+    exit 4;
+}
+`
+
+var namedTemplatesVersion = gv.Must(gv.NewVersion("8.3.0"))
+
+// installNotifyTemplates creates the borgmox templates, unless they were already created (and maybe customized).
+// They go to the cluster filesystem, since the files of pve-manager are replaced by its upgrades.
+func installNotifyTemplates() error {
+	templates := map[string]string{
+		notifyTemplateName + "-subject.txt.hbs": notifyTitleTemplate + "\n",
+		notifyTemplateName + "-body.txt.hbs":    notifyMessageTemplate + "\n",
+	}
+	for name, content := range templates {
+		path := filepath.Join(notifyTemplateDir, name)
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+		if err := os.MkdirAll(notifyTemplateDir, 0755); err != nil {
+			return fmt.Errorf("cannot create %v: %w, create it and the file %v containing %q by hand", notifyTemplateDir, err, path, content)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			return fmt.Errorf("cannot install the notification template %v: %w, create it by hand containing %q", path, err, content)
+		}
+	}
+	return nil
+}
+
+// SendNotification sends a notification through the notification targets and matchers of PVE (8.1 or newer),
+// see the signatures of PVE::Notify::notify above.
+// fields are matched by the "match-field" rules of the matchers.
+func SendNotification(severity NotifySeverity, title string, message string, fields map[string]string) error {
+	pveVersion, err := GetVersion()
+	if err != nil {
+		return err
+	}
+
+	input := map[string]any{
+		"severity": string(severity),
+		"title":    title,
+		"message":  message,
+		"fields":   fields,
+	}
+	if pveVersion.GreaterThanOrEqual(namedTemplatesVersion) {
+		if err := installNotifyTemplates(); err != nil {
+			return err
+		}
+		input["template"] = notifyTemplateName
+	} else {
+		input["title_template"] = notifyTitleTemplate
+		input["message_template"] = notifyMessageTemplate
+	}
+
+	data, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "perl", "-e", notifyScript)
+	cmd.Stdin = bytes.NewReader(data)
+	output, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if err == nil {
+		return nil
+	} else if errors.As(err, &exitErr) && exitErr.ExitCode() == notifyMissing {
+		return fmt.Errorf("PVE %v has no PVE::Notify::notify, the pve notifier supports pve-manager 8.1 to 8.4", pveVersion.Original())
+	} else if errors.As(err, &exitErr) && exitErr.ExitCode() == notifyFailed {
+		return fmt.Errorf("PVE::Notify::notify failed on PVE %v, past pve-manager 8.4 its signature may have changed: %v", pveVersion.Original(), strings.TrimSpace(string(output)))
+	}
+	return fmt.Errorf("PVE::Notify returned an error: %w: %v", err, strings.TrimSpace(string(output)))
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"borgmox/Job"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+func runAudit(args []string) error {
+	var jobData Job.JobData
+
+	flags := flag.NewFlagSet("audit", flag.ExitOnError)
+	logging := addLogFlags(flags)
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if err := logging.setup(); err != nil {
+		return exitWith(EX_Config, err)
+	}
+
+	if len(flags.Args()) < 1 {
+		return exitWith(EX_Config, fmt.Errorf("usage: %s audit [options] [input.toml] [job name...]", os.Args[0]))
+	}
+
+	if err := loadJobData(flags.Arg(0), &jobData); err != nil {
+		return exitWith(EX_Config, err)
+	}
+
+	if err := checkProxmoxVersion(); err != nil {
+		return exitWith(EX_Precondition, err)
+	}
+
+	if err := checkBorgVersion(); err != nil {
+		return exitWith(EX_Precondition, err)
+	}
+
+	r := jobData.RunAudit(Job.AuditOptions{
+		Jobs: flags.Args()[1:],
+	}, os.Stdout)
+
+	for jobName, val := range r {
+		if val.Error != nil {
+			slog.Error("Backup Job failed", "job", jobName, "error", val.Error)
+		}
+	}
+
+	return runOutcome(r, jobData.FailedNotifications())
+}
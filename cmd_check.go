@@ -0,0 +1,50 @@
+package main
+
+import (
+	"borgmox/Job"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+func runCheck(args []string) error {
+	var jobData Job.JobData
+
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	logging := addLogFlags(flags)
+	force := flags.Bool("force", false, "checks the repositories even if their last check is recent enough")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if err := logging.setup(); err != nil {
+		return exitWith(EX_Config, err)
+	}
+
+	if len(flags.Args()) < 1 {
+		return exitWith(EX_Config, fmt.Errorf("usage: %s check [options] [input.toml] [job name...]", os.Args[0]))
+	}
+
+	if err := loadJobData(flags.Arg(0), &jobData); err != nil {
+		return exitWith(EX_Config, err)
+	}
+
+	if err := checkBorgVersion(); err != nil {
+		return exitWith(EX_Precondition, err)
+	}
+
+	r := jobData.RunCheck(Job.CheckOptions{
+		Jobs:  flags.Args()[1:],
+		Force: *force,
+	})
+
+	for jobName, val := range r {
+		if val.Error != nil {
+			slog.Error("Backup Job failed", "job", jobName, "error", val.Error)
+		}
+	}
+
+	return runOutcome(r, nil)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"borgmox/BorgCLI"
+	"borgmox/Job"
+	"flag"
+	"fmt"
+	"os"
+)
+
+func runInitRepo(args []string) error {
+	var jobData Job.JobData
+
+	flags := flag.NewFlagSet("init-repo", flag.ExitOnError)
+	logging := addLogFlags(flags)
+	repository := flags.String("repository", "", "repository to initialize, if not the job's primary one (i.e. one of its replicas)")
+	encryption := flags.String("encryption", string(BorgCLI.ENC_RepokeyBlake2), "borg encryption mode of the new repository (see \"borg init --help\")")
+	keyExportPath := flags.String("export-key", "", "path the repository key will be exported to; must not exist yet")
+	paperKey := flags.Bool("paper", false, "exports the repository key in the printable \"--paper\" format")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if err := logging.setup(); err != nil {
+		return exitWith(EX_Config, err)
+	}
+
+	if len(flags.Args()) != 2 {
+		return exitWith(EX_Config, fmt.Errorf("usage: %s init-repo [options] [input.toml] [job name]", os.Args[0]))
+	}
+
+	if err := loadJobData(flags.Arg(0), &jobData); err != nil {
+		return exitWith(EX_Config, err)
+	}
+
+	if err := checkBorgVersion(); err != nil {
+		return exitWith(EX_Precondition, err)
+	}
+
+	return jobData.InitRepository(flags.Arg(1), Job.InitRepoOptions{
+		Repository:    *repository,
+		Encryption:    BorgCLI.EncryptionMode(*encryption),
+		KeyExportPath: *keyExportPath,
+		PaperKey:      *paperKey,
+	})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"borgmox/BorgCLI"
+	"borgmox/Job"
+	"errors"
+)
+
+// Exit codes of borgmox, see "Exit codes" in the README
+const (
+	EX_Success = 0
+	// Everything ran, but borg logged warnings
+	EX_Warning = 1
+	// Invalid options or configuration, like the flag package's own usage errors
+	EX_Config = 2
+	// Some backups, prunes, checks or notifications failed, others went through
+	EX_Partial = 3
+	// Nothing went through
+	EX_Failure = 4
+	// Nothing ran: proxmox or borg are too old, or the repositories are locked
+	EX_Precondition = 5
+)
+
+// exitError ends borgmox with a specific exit code.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+func exitWith(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &exitError{code: code, err: err}
+}
+
+// exitCode returns the code borgmox exits with after err, errors without one are failures.
+func exitCode(err error) int {
+	var exitErr *exitError
+	if err == nil {
+		return EX_Success
+	} else if errors.As(err, &exitErr) {
+		return exitErr.code
+	}
+	return EX_Failure
+}
+
+// isLocked reports whether err comes from a repository that borg couldn't lock.
+func isLocked(err error) bool {
+	return errors.Is(err, BorgCLI.ErrLockTimeout) || errors.Is(err, BorgCLI.ErrLockFailed)
+}
+
+// runOutcome sums up the results of the jobs into the error, and exit code, of the run.
+// failedNotifications are the undelivered notifications of the run that belong to no job.
+func runOutcome(results map[string]Job.JobResult, failedNotifications []error) error {
+	failures := []error{}
+	succeeded := false
+	partial := false
+	warnings := false
+	undelivered := len(failedNotifications) > 0
+	for _, result := range results {
+		failures = append(failures, result.Failures()...)
+		succeeded = succeeded || result.Succeeded()
+		partial = partial || result.IsPartial()
+		warnings = warnings || result.HasWarnings()
+		undelivered = undelivered || len(result.FailedNotifications) > 0
+	}
+
+	// Prunes are refused when the backups of the run failed, these refusals don't tell why
+	locked := false
+	for _, err := range failures {
+		var skipErr *Job.PruneSkipError
+		if isLocked(err) {
+			locked = true
+		} else if !errors.As(err, &skipErr) {
+			locked = false
+			break
+		}
+	}
+
+	if locked && !succeeded {
+		return exitWith(EX_Precondition, errors.New("operation failed: the repositories are locked"))
+	} else if len(failures) > 0 && !succeeded {
+		return exitWith(EX_Failure, errors.New("operation failed"))
+	} else if len(failures) > 0 {
+		return exitWith(EX_Partial, errors.New("operation partially failed"))
+	} else if partial {
+		return exitWith(EX_Partial, errors.New("operation partially failed: some replicas did not receive their backups"))
+	} else if undelivered {
+		return exitWith(EX_Partial, errors.New("some notifications could not be delivered, they will be sent again on the next run"))
+	} else if warnings {
+		return exitWith(EX_Warning, errors.New("operation succeeded, borg logged some warnings"))
+	}
+	return nil
+}
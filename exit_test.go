@@ -0,0 +1,180 @@
+package main
+
+import (
+	"borgmox/BorgCLI"
+	"borgmox/Job"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestRunOutcome(t *testing.T) {
+	lockErr := fmt.Errorf("borg failed: %w", &BorgCLI.Error{MsgID: BorgCLI.MSG_LockTimeout, ExitCode: 2})
+	skipErr := fmt.Errorf("/repo: %w", &Job.PruneSkipError{Reason: "the backup of this run failed"})
+	warning := &BorgCLI.Error{ExitCode: 1, Warnings: []string{"file changed while we backed it up"}}
+
+	tests := []struct {
+		name                string
+		results             map[string]Job.JobResult
+		failedNotifications []error
+		code                int
+	}{
+		{
+			name: "success",
+			results: map[string]Job.JobResult{
+				"J1": {SucceededBackups: map[uint64]struct{}{100: {}}, SucceededPrunes: map[uint64]struct{}{100: {}}},
+			},
+			code: EX_Success,
+		},
+		{
+			name:    "nothing to do",
+			results: map[string]Job.JobResult{"J1": {}},
+			code:    EX_Success,
+		},
+		{
+			name: "warning",
+			results: map[string]Job.JobResult{
+				"J1": {
+					SucceededBackups: map[uint64]struct{}{100: {}},
+					BackupWarnings:   map[uint64]error{100: warning},
+				},
+			},
+			code: EX_Warning,
+		},
+		{
+			name: "orphan prune warning",
+			results: map[string]Job.JobResult{
+				"J1": {
+					SucceededBackups: map[uint64]struct{}{100: {}},
+					Orphans:          []Job.OrphanResult{{VMID: 999, Decision: Job.OD_Pruned, Warning: warning}},
+				},
+			},
+			code: EX_Warning,
+		},
+		{
+			name: "some backups failed",
+			results: map[string]Job.JobResult{
+				"J1": {
+					SucceededBackups: map[uint64]struct{}{100: {}},
+					FailedBackups:    map[uint64]error{101: errors.New("vzdump failed")},
+				},
+			},
+			code: EX_Partial,
+		},
+		{
+			name: "one job failed, another succeeded",
+			results: map[string]Job.JobResult{
+				"J1": {SucceededBackups: map[uint64]struct{}{100: {}}},
+				"J2": {Error: errors.New("cannot read pool")},
+			},
+			code: EX_Partial,
+		},
+		{
+			name: "replica failed",
+			results: map[string]Job.JobResult{
+				"J1": {
+					SucceededBackups:     map[uint64]struct{}{100: {}},
+					FailedReplicaBackups: map[uint64]error{100: errors.New("/mnt/replica: borg failed")},
+				},
+			},
+			code: EX_Partial,
+		},
+		{
+			name: "undelivered job notification",
+			results: map[string]Job.JobResult{
+				"J1": {
+					SucceededBackups:    map[uint64]struct{}{100: {}},
+					BackupWarnings:      map[uint64]error{100: warning},
+					FailedNotifications: []error{errors.New("ntfy returned 503")},
+				},
+			},
+			code: EX_Partial,
+		},
+		{
+			name: "undelivered digest",
+			results: map[string]Job.JobResult{
+				"J1": {SucceededBackups: map[uint64]struct{}{100: {}}},
+			},
+			failedNotifications: []error{errors.New("smtp: connection refused")},
+			code:                EX_Partial,
+		},
+		{
+			name: "every backup failed",
+			results: map[string]Job.JobResult{
+				"J1": {
+					FailedBackups: map[uint64]error{100: errors.New("vzdump failed")},
+					FailedPrunes:  map[uint64]error{100: skipErr},
+				},
+			},
+			code: EX_Failure,
+		},
+		{
+			name: "job configuration",
+			results: map[string]Job.JobResult{
+				"J1": {Error: errors.New("cannot read pool p")},
+			},
+			code: EX_Failure,
+		},
+		{
+			name: "repositories locked",
+			results: map[string]Job.JobResult{
+				"J1": {
+					FailedBackups: map[uint64]error{100: lockErr, 101: lockErr},
+					FailedPrunes:  map[uint64]error{100: skipErr, 101: skipErr},
+				},
+			},
+			code: EX_Precondition,
+		},
+		{
+			name: "locked, and failed for another reason",
+			results: map[string]Job.JobResult{
+				"J1": {FailedBackups: map[uint64]error{100: lockErr, 101: errors.New("vzdump failed")}},
+			},
+			code: EX_Failure,
+		},
+		{
+			name: "locked, but some backups went through",
+			results: map[string]Job.JobResult{
+				"J1": {
+					SucceededBackups: map[uint64]struct{}{100: {}},
+					FailedBackups:    map[uint64]error{101: lockErr},
+				},
+			},
+			code: EX_Partial,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := runOutcome(test.results, test.failedNotifications)
+			if code := exitCode(err); code != test.code {
+				t.Errorf("exit code = %v (%v), want %v", code, err, test.code)
+			}
+		})
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	configErr := exitWith(EX_Config, loadJobData("/nonexistent/borgmox.toml", &Job.JobData{}))
+
+	tests := []struct {
+		name string
+		err  error
+		code int
+	}{
+		{name: "success", err: nil, code: EX_Success},
+		{name: "no error to exit with", err: exitWith(EX_Failure, nil), code: EX_Success},
+		{name: "configuration", err: configErr, code: EX_Config},
+		{name: "wrapped", err: fmt.Errorf("init-repo: %w", configErr), code: EX_Config},
+		{name: "precondition", err: exitWith(EX_Precondition, errors.New("borg is too old")), code: EX_Precondition},
+		{name: "without a code", err: errors.New("unexpected"), code: EX_Failure},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if code := exitCode(test.err); code != test.code {
+				t.Errorf("exitCode(%v) = %v, want %v", test.err, code, test.code)
+			}
+		})
+	}
+}
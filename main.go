@@ -4,7 +4,6 @@ import (
 	"borgmox/BorgCLI"
 	"borgmox/Job"
 	"borgmox/ProxmoxCLI"
-	"errors"
 	"flag"
 	"fmt"
 	"os"
@@ -13,57 +12,333 @@ import (
 	"github.com/pelletier/go-toml/v2"
 )
 
+func loadJobData(path string, jobData *Job.JobData) error {
+	if jobFile, err := os.ReadFile(path); err != nil {
+		return fmt.Errorf("couldn't open toml input file: %w", err)
+	} else if err := toml.Unmarshal(jobFile, jobData); err != nil {
+		return fmt.Errorf("couldn't decode toml input file: %w", err)
+	}
+	if err := jobData.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	return nil
+}
+
+func checkProxmoxVersion() error {
+	proxmoxVer, err := ProxmoxCLI.GetVersion()
+	if err != nil {
+		return fmt.Errorf("cannot verify proxmox version: %w", err)
+	}
+
+	if targetMinimumVersion, err := version.NewVersion("8.0.0"); err != nil {
+		return fmt.Errorf("cannot compare proxmox version; semver error: %w", err)
+	} else if proxmoxVer.LessThan(targetMinimumVersion) {
+		return fmt.Errorf("current proxmox version: %v, minimum version required: %v", proxmoxVer.Original(), targetMinimumVersion.Original())
+	}
+	return nil
+}
+
+func checkBorgVersion() error {
+	borgVer, err := BorgCLI.GetVersion()
+	if err != nil {
+		return fmt.Errorf("cannot verify borg version: %w", err)
+	}
+
+	if targetMinimumVersion, err := version.NewVersion("1.2.4"); err != nil {
+		return fmt.Errorf("cannot compare borg version; semver error: %w", err)
+	} else if borgVer.LessThan(targetMinimumVersion) {
+		return fmt.Errorf("current borg version: %v, minimum version required: %v", borgVer.Original(), targetMinimumVersion.Original())
+	}
+	return nil
+}
+
+// logFlags are the logging options of every command.
+type logFlags struct {
+	format *string
+	level  *string
+}
+
+func addLogFlags(flags *flag.FlagSet) logFlags {
+	return logFlags{
+		format: flags.String("log-format", string(Job.LF_Text), "format of the log records on stderr: text or json"),
+		level:  flags.String("log-level", "info", "lowest level that is logged: debug, info, warn or error"),
+	}
+}
+
+func (l logFlags) setup() error {
+	return Job.SetupLogging(Job.LogFormat(*l.format), *l.level)
+}
+
 func runMain() error {
 	var jobData Job.JobData
 
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "init-repo":
+			return runInitRepo(os.Args[2:])
+		case "check":
+			return runCheck(os.Args[2:])
+		case "audit":
+			return runAudit(os.Args[2:])
+		}
+	}
+
 	dontBackup := flag.Bool("no-backup", false, "disables backing up any VM/LXC, useful for only running prune jobs")
 	dontPrune := flag.Bool("no-prune", false, "disables all prune jobs, useful for only running backup jobs")
+	dontCheck := flag.Bool("no-check", false, "disables the repository checks that run after a job")
+	dryRun := flag.Bool("dry-run", false, "prints the commands that would run, and the archives that would be pruned, without running any backup")
+	reportFile := flag.String("report-file", "", "writes a JSON report of the run to this path, instead of the configured ReportFile")
 	outputSampleToml := flag.Bool("stdout-sample-toml", false, "disables all processing and prints a sample toml file")
+	logging := addLogFlags(flag.CommandLine)
 
 	flag.Parse()
 
+	if err := logging.setup(); err != nil {
+		return exitWith(EX_Config, err)
+	}
+
 	if *outputSampleToml {
+		jobData.StateDirectory = Job.DefaultStateDirectory
+		jobData.Heartbeat = Job.HeartbeatSettings{
+			URL:    "",
+			Preset: Job.HP_Healthchecks,
+		}
+		jobData.Digest = Job.DigestSettings{
+			NotificationTargetInfo: Job.NotificationTargetInfo{
+				Frequency:       Job.NF_Never,
+				SuccessPriority: Job.NP_Low,
+				FailurePriority: Job.NP_High,
+			},
+			Notifications: []Job.NotifierBackend{
+				{
+					Type: Job.NT_Ntfy,
+					Ntfy: &Job.NtfySettings{
+						TargetServer: "",
+						AuthUser:     "",
+						AuthPassword: "my_access_token",
+						Topic:        "MyDigestTopic",
+					},
+				},
+			},
+		}
+		jobData.GuestLogs = Job.GuestLogSettings{
+			Enabled:    true,
+			Directory:  "",
+			KeepRuns:   14,
+			MaxSize:    64,
+			ErrorLines: 5,
+		}
+		jobData.ReportFile = ""
 		jobData.BackupJobs = map[string]Job.BackupJobSettings{
 			"My Job": {
-				ArchivePrefix: "",
-				VmPool:        []string{"my_proxmox_vm_pool", "my_proxmox_lxc_pool"},
-				VmMode:        Job.VMBKP_Image,
-				LxcMode:       Job.LXCBKP_Image,
+				ArchivePrefix:       "",
+				ArchiveNameTemplate: Job.DefaultArchiveNameTemplate,
+				ArchiveTimezone:     "UTC",
+				VmPool:              []string{"my_proxmox_vm_pool", "my_proxmox_lxc_pool"},
+				VmMode:              Job.VMBKP_Image,
+				LxcMode:             Job.LXCBKP_Image,
 				Notification: Job.NotificationSettings{
-					BackupTargetInfo: Job.NotificationTargetInfo{
-						Frequency:          Job.NF_EntireJobFinished,
-						SuccessPriority:    Job.NP_Default,
-						FailurePriority:    Job.NP_High,
-						SuccessEmailTarget: "",
-						FailureEmailTarget: "",
+					NotificationTargets: Job.NotificationTargets{
+						BackupTargetInfo: Job.NotificationTargetInfo{
+							Frequency:          Job.NF_EntireJobFinished,
+							SuccessPriority:    Job.NP_Default,
+							FailurePriority:    Job.NP_High,
+							SuccessEmailTarget: "",
+							FailureEmailTarget: "",
+						},
+						PruneTargetInfo: Job.NotificationTargetInfo{
+							Frequency:          Job.NF_EveryVmFinished,
+							SuccessPriority:    Job.NP_Default,
+							FailurePriority:    Job.NP_High,
+							SuccessEmailTarget: "",
+							FailureEmailTarget: "",
+						},
+						CheckTargetInfo: Job.NotificationTargetInfo{
+							Frequency:          Job.NF_EntireJobFinished,
+							SuccessPriority:    Job.NP_Low,
+							FailurePriority:    Job.NP_Urgent,
+							SuccessEmailTarget: "",
+							FailureEmailTarget: "",
+						},
+					},
+					NtfySettings: Job.NtfySettings{
+						TargetServer: "",
+						AuthUser:     "my_user_or_empty_for_access_token",
+						AuthPassword: "my_user_password_or_token",
+						Topic:        "MyNotificationTopic",
+					},
+				},
+				Notifications: []Job.NotifierSettings{
+					{
+						NotifierBackend: Job.NotifierBackend{
+							Type: Job.NT_Ntfy,
+							NotificationTemplates: Job.NotificationTemplates{
+								TitleTemplate: "[{{.Host}}] {{.DefaultTitle}}",
+							},
+							Ntfy: &Job.NtfySettings{
+								TargetServer: "",
+								AuthUser:     "",
+								AuthPassword: "my_access_token",
+								Topic:        "MyOnCallTopic",
+							},
+						},
+						NotificationTargets: Job.NotificationTargets{
+							BackupTargetInfo: Job.NotificationTargetInfo{
+								Frequency:       Job.NF_EntireJobFinished,
+								SuccessPriority: Job.NP_Disabled,
+								FailurePriority: Job.NP_Urgent,
+								Tags:            []string{"proxmox"},
+								Markdown:        true,
+								AttachLog:       true,
+								Click:           "https://dashboard.example.com/backups",
+								Actions:         "view, Open dashboard, https://dashboard.example.com/backups",
+							},
+							PruneTargetInfo: Job.NotificationTargetInfo{
+								Frequency:       Job.NF_EntireJobFinished,
+								SuccessPriority: Job.NP_Disabled,
+								FailurePriority: Job.NP_High,
+							},
+							CheckTargetInfo: Job.NotificationTargetInfo{
+								Frequency:       Job.NF_EntireJobFinished,
+								SuccessPriority: Job.NP_Disabled,
+								FailurePriority: Job.NP_Urgent,
+							},
+						},
+					},
+					{
+						NotifierBackend: Job.NotifierBackend{
+							Type: Job.NT_Smtp,
+							Smtp: &Job.SmtpSettings{
+								Server:   "smtp.example.com:587",
+								Security: Job.SS_StartTLS,
+								User:     "borgmox@example.com",
+								Password: "my-smtp-password",
+								From:     "borgmox@example.com",
+								To:       []string{"ops@example.com"},
+								Sendmail: "/usr/sbin/sendmail",
+							},
+						},
+						NotificationTargets: Job.NotificationTargets{
+							BackupTargetInfo: Job.NotificationTargetInfo{
+								Frequency:       Job.NF_EntireJobFinished,
+								SuccessPriority: Job.NP_Default,
+								FailurePriority: Job.NP_High,
+							},
+							PruneTargetInfo: Job.NotificationTargetInfo{
+								Frequency:       Job.NF_EntireJobFinished,
+								SuccessPriority: Job.NP_Disabled,
+								FailurePriority: Job.NP_High,
+							},
+							CheckTargetInfo: Job.NotificationTargetInfo{
+								Frequency:       Job.NF_EntireJobFinished,
+								SuccessPriority: Job.NP_Disabled,
+								FailurePriority: Job.NP_High,
+							},
+						},
 					},
-					PruneTargetInfo: Job.NotificationTargetInfo{
-						Frequency:          Job.NF_EveryVmFinished,
-						SuccessPriority:    Job.NP_Default,
-						FailurePriority:    Job.NP_High,
-						SuccessEmailTarget: "",
-						FailureEmailTarget: "",
+					{
+						NotifierBackend: Job.NotifierBackend{
+							Type: Job.NT_Webhook,
+							Webhook: &Job.WebhookSettings{
+								URL:    "https://hooks.slack.com/services/T000/B000/XXXX",
+								Preset: Job.WP_Slack,
+								Secret: "",
+								Headers: map[string]string{
+									"X-Environment": "production",
+								},
+							},
+						},
+						NotificationTargets: Job.NotificationTargets{
+							BackupTargetInfo: Job.NotificationTargetInfo{
+								Frequency:       Job.NF_EntireJobFinished,
+								SuccessPriority: Job.NP_Default,
+								FailurePriority: Job.NP_High,
+							},
+							PruneTargetInfo: Job.NotificationTargetInfo{
+								Frequency:       Job.NF_EntireJobFinished,
+								SuccessPriority: Job.NP_Disabled,
+								FailurePriority: Job.NP_High,
+							},
+							CheckTargetInfo: Job.NotificationTargetInfo{
+								Frequency:       Job.NF_EntireJobFinished,
+								SuccessPriority: Job.NP_Disabled,
+								FailurePriority: Job.NP_High,
+							},
+						},
+					},
+					{
+						NotifierBackend: Job.NotifierBackend{
+							Type: Job.NT_Pve,
+						},
+						NotificationTargets: Job.NotificationTargets{
+							BackupTargetInfo: Job.NotificationTargetInfo{
+								Frequency:       Job.NF_EntireJobFinished,
+								SuccessPriority: Job.NP_Default,
+								FailurePriority: Job.NP_High,
+							},
+							PruneTargetInfo: Job.NotificationTargetInfo{
+								Frequency:       Job.NF_EntireJobFinished,
+								SuccessPriority: Job.NP_Default,
+								FailurePriority: Job.NP_High,
+							},
+							CheckTargetInfo: Job.NotificationTargetInfo{
+								Frequency:       Job.NF_EntireJobFinished,
+								SuccessPriority: Job.NP_Default,
+								FailurePriority: Job.NP_High,
+							},
+						},
+					},
+				},
+				Heartbeat: Job.HeartbeatSettings{
+					URL:    "",
+					Preset: Job.HP_UptimeKuma,
+				},
+				OrphanPolicy: Job.OP_Report,
+				OrphanPrune: BorgCLI.BorgKeepSettings{
+					KeepLast:    1,
+					KeepMonthly: 3,
+				},
+				MaxAge: "26h",
+				PruneOverrides: []Job.PruneOverride{
+					{
+						VMIDs: []uint64{100},
+						Tags:  []string{"keep-long"},
+						BorgKeepSettings: BorgCLI.BorgKeepSettings{
+							KeepDaily:   7,
+							KeepWeekly:  8,
+							KeepMonthly: 24,
+						},
 					},
-					TargetServer: "",
-					AuthUser:     "my_user_or_empty_for_access_token",
-					AuthPassword: "my_user_password_or_token",
-					Topic:        "MyNotificationTopic",
 				},
 				Borg: BorgCLI.BorgSettings{
 					Repository: "ssh://my_borg_repo",
 					RemotePath: "/my/remote/borg/path/if/needed/or/empty",
 					Passphrase: "my-borg-passphrase",
 					Prune: BorgCLI.BorgPruneSettings{
-						Enabled:      false,
-						Compact:      true,
-						KeepWithin:   "15d",
-						KeepLast:     10,
-						KeepMinutely: 0,
-						KeepHourly:   0,
-						KeepDaily:    0,
-						KeepWeekly:   8,
-						KeepMonthly:  12,
-						KeepYearly:   10,
+						Enabled:          false,
+						Compact:          true,
+						CompactThreshold: 10,
+						CompactEveryDays: 1,
+						MinRemaining:     3,
+						MaxDeletions:     20,
+						BorgKeepSettings: BorgCLI.BorgKeepSettings{
+							KeepWithin:   "15d",
+							KeepLast:     10,
+							KeepMinutely: 0,
+							KeepHourly:   0,
+							KeepDaily:    0,
+							KeepWeekly:   8,
+							KeepMonthly:  12,
+							KeepYearly:   10,
+						},
+					},
+					Check: BorgCLI.BorgCheckSettings{
+						Enabled:     false,
+						AfterJob:    true,
+						EveryDays:   7,
+						Mode:        BorgCLI.CHK_Full,
+						VerifyData:  false,
+						MaxDuration: 0,
 					},
 				},
 			},
@@ -78,64 +353,42 @@ func runMain() error {
 	}
 
 	if len(flag.Args()) != 1 {
-		return fmt.Errorf("usage: %s [input.toml]", os.Args[0])
-	}
-
-	if jobFile, err := os.ReadFile(flag.Args()[0]); err != nil {
-		return fmt.Errorf("couldn't open toml input file: %w", err)
-	} else if err := toml.Unmarshal(jobFile, &jobData); err != nil {
-		return fmt.Errorf("couldn't decode toml input file: %w", err)
-	}
-
-	proxmoxVer, err := ProxmoxCLI.GetVersion()
-	if err != nil {
-		return fmt.Errorf("cannot verify proxmox version: %w", err)
+		return exitWith(EX_Config, fmt.Errorf("usage: %s [input.toml]\n       %s init-repo [options] [input.toml] [job name]\n       %s check [options] [input.toml] [job name...]\n       %s audit [options] [input.toml] [job name...]", os.Args[0], os.Args[0], os.Args[0], os.Args[0]))
 	}
 
-	if targetMinimumVersion, err := version.NewVersion("8.0.0"); err != nil {
-		return fmt.Errorf("cannot compare proxmox version; semver error: %w", err)
-	} else if proxmoxVer.LessThan(targetMinimumVersion) {
-		return fmt.Errorf("current proxmox version: %v, minimum version required: %v", proxmoxVer.Original(), targetMinimumVersion.Original())
+	if err := loadJobData(flag.Args()[0], &jobData); err != nil {
+		return exitWith(EX_Config, err)
 	}
 
-	borgVer, err := BorgCLI.GetVersion()
-	if err != nil {
-		return fmt.Errorf("cannot verify borg version: %w", err)
+	if err := checkProxmoxVersion(); err != nil {
+		return exitWith(EX_Precondition, err)
 	}
-
-	if targetMinimumVersion, err := version.NewVersion("1.2.4"); err != nil {
-		return fmt.Errorf("cannot compare borg version; semver error: %w", err)
-	} else if borgVer.LessThan(targetMinimumVersion) {
-		return fmt.Errorf("current borg version: %v, minimum version required: %v", borgVer.Original(), targetMinimumVersion.Original())
+	if err := checkBorgVersion(); err != nil {
+		return exitWith(EX_Precondition, err)
 	}
 
 	// Run the effective backup job
-	operationError := errors.New("operation failed")
-
-	r := jobData.RunJob(Job.JobOptions{
+	options := Job.JobOptions{
 		DontBackup: *dontBackup,
 		DontPrune:  *dontPrune,
-	})
+		DontCheck:  *dontCheck,
+		DryRun:     *dryRun,
+		ReportFile: *reportFile,
+	}
+	r := jobData.RunJob(options)
 
-	for _, val := range r {
-		if val.Error != nil {
-			return operationError
-		}
-		if len(val.FailedBackups) > 0 {
-			return operationError
-		}
-		if len(val.FailedPrunes) > 0 {
-			return operationError
-		}
+	if !*dryRun {
+		jobData.SendDigest(r)
+		jobData.WriteReport(options, r)
 	}
 
-	return nil
+	return runOutcome(r, jobData.FailedNotifications())
 }
 
 func main() {
 	if err := runMain(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		os.Exit(exitCode(err))
 	}
 	os.Exit(0)
 }